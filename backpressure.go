@@ -0,0 +1,175 @@
+package skynetclusterd
+
+import (
+	"context"
+	"sync"
+)
+
+// OverloadPolicy 节点的请求超过 WithMaxInFlight/WithMaxQueuedBytes 限制时的处理方式
+type OverloadPolicy int
+
+const (
+	// OverloadBlock 等待其他请求完成, ctx 结束时返回 ErrTimeout 或者 ctx.Err()
+	OverloadBlock OverloadPolicy = iota
+	// OverloadFail 直接返回 ErrOverloaded
+	OverloadFail
+)
+
+// limiter 一个节点所有链接上等待回应的请求数量和还未写出的字节数, 节点的链接共用
+type limiter struct {
+	maxInFlight int
+	maxQueued   int
+	policy      OverloadPolicy
+
+	mu       sync.Mutex
+	inflight int
+	queued   int
+	wakeup   chan struct{} // 有等待者时非 nil, 释放时关闭
+}
+
+// WithMaxInFlight 每个节点最多等待回应的请求数量, 默认不限制
+func WithMaxInFlight(n int) Option {
+	return func(c *Cluster) {
+		c.maxInFlight = n
+	}
+}
+
+// WithMaxQueuedBytes 每个节点最多还未写出的请求字节数, 默认不限制
+func WithMaxQueuedBytes(n int) Option {
+	return func(c *Cluster) {
+		c.maxQueued = n
+	}
+}
+
+// WithOverloadPolicy 超过限制时等待还是返回 ErrOverloaded, 默认等待
+func WithOverloadPolicy(policy OverloadPolicy) Option {
+	return func(c *Cluster) {
+		c.overloadPolicy = policy
+	}
+}
+
+func newLimiter(c *Cluster) *limiter {
+	return &limiter{
+		maxInFlight: c.maxInFlight,
+		maxQueued:   c.maxQueued,
+		policy:      c.overloadPolicy,
+	}
+}
+
+// fits 没有其他请求时总是允许, 避免单个超过限制的请求永远等待
+func (l *limiter) fits(sessions, bytes int) bool {
+	if l.maxInFlight > 0 && sessions > 0 && l.inflight > 0 && l.inflight+sessions > l.maxInFlight {
+		return false
+	}
+	if l.maxQueued > 0 && bytes > 0 && l.queued > 0 && l.queued+bytes > l.maxQueued {
+		return false
+	}
+	return true
+}
+
+// acquire 登记 sessions 个等待回应的请求和 bytes 字节的待写数据
+func (l *limiter) acquire(ctx context.Context, sessions, bytes int) error {
+	if l == nil {
+		return nil
+	}
+	for {
+		l.mu.Lock()
+		if l.fits(sessions, bytes) {
+			l.inflight += sessions
+			l.queued += bytes
+			l.mu.Unlock()
+			return nil
+		}
+		if l.policy == OverloadFail {
+			l.mu.Unlock()
+			return ErrOverloaded
+		}
+		if l.wakeup == nil {
+			l.wakeup = make(chan struct{})
+		}
+		wakeup := l.wakeup
+		l.mu.Unlock()
+
+		select {
+		case <-wakeup:
+		case <-ctx.Done():
+			return ctxErr(ctx)
+		}
+	}
+}
+
+// reserve 不检查限制直接登记
+func (l *limiter) reserve(sessions, bytes int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.inflight += sessions
+	l.queued += bytes
+	l.mu.Unlock()
+}
+
+func (l *limiter) release(sessions, bytes int) {
+	if l == nil || (sessions == 0 && bytes == 0) {
+		return
+	}
+	l.mu.Lock()
+	l.inflight -= sessions
+	l.queued -= bytes
+	if l.wakeup != nil {
+		close(l.wakeup)
+		l.wakeup = nil
+	}
+	l.mu.Unlock()
+}
+
+// limiter 节点的 limiter, 节点移除后保留, 还未关闭的旧链接继续使用
+func (mgr *SenderMgr) limiter(node string) *limiter {
+	l, ok := mgr.limiters[node]
+	if !ok {
+		l = newLimiter(mgr.c)
+		mgr.limiters[node] = l
+	}
+	return l
+}
+
+// queue 登记链接上还未写出的字节数, 链接已经关闭时直接释放
+func (agent *SenderAgent) queue(bytes int) {
+	agent.queueMu.Lock()
+	if agent.queueClosed {
+		agent.queueMu.Unlock()
+		agent.limiter.release(0, bytes)
+		return
+	}
+	agent.queued += bytes
+	agent.queueMu.Unlock()
+}
+
+// unqueue 数据交给链接写出时释放
+func (agent *SenderAgent) unqueue(bytes int) {
+	agent.queueMu.Lock()
+	if agent.queueClosed {
+		agent.queueMu.Unlock()
+		return
+	}
+	agent.queued -= bytes
+	agent.queueMu.Unlock()
+	agent.limiter.release(0, bytes)
+}
+
+// closeQueue 链接关闭后发送队列中的数据不会再写出, 释放所有字节数
+func (agent *SenderAgent) closeQueue() {
+	agent.queueMu.Lock()
+	bytes := agent.queued
+	agent.queued = 0
+	agent.queueClosed = true
+	agent.queueMu.Unlock()
+	agent.limiter.release(0, bytes)
+}
+
+// QueuedBytes 链接上还未写出的请求字节数
+func (agent *SenderAgent) QueuedBytes() int {
+	agent.queueMu.Lock()
+	defer agent.queueMu.Unlock()
+	return agent.queued
+}
@@ -0,0 +1,96 @@
+package skynetclusterd
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMaxInFlight(t *testing.T) {
+	release := make(chan struct{})
+	server, addr := startPoolServer(t, release)
+	defer server.Shutdown(context.Background())
+	failFast := New(WithMaxInFlight(2), WithOverloadPolicy(OverloadFail))
+	blocking := New(WithMaxInFlight(1))
+	for _, c := range []*Cluster{failFast, blocking} {
+		c.RegisterNode("server", addr)
+		defer c.Shutdown(context.Background())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	f1 := failFast.CallAsync(ctx, "server", "pool", "block")
+	f2 := failFast.CallAsync(ctx, "server", "pool", "block")
+	if ok, resp := failFast.Call(ctx, "server", "pool", "echo", ""); ok || resp != ErrOverloaded.Error() {
+		t.Errorf("call over limit got %v %s", ok, resp)
+	}
+	if err := failFast.Send(ctx, "server", "pool", "echo", ""); err != nil {
+		t.Errorf("send over in-flight limit got %v", err)
+	}
+
+	// 等待的请求在 ctx 结束时返回 ErrTimeout, 有空闲时继续发送
+	f3 := blocking.CallAsync(ctx, "server", "pool", "block")
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := blocking.CallMulti(short, "server", "pool", "echo"); !errors.Is(err, ErrTimeout) {
+		t.Errorf("blocked call got %v", err)
+	}
+	waiting := make(chan error)
+	go func() {
+		_, err := blocking.CallMulti(ctx, "server", "pool", "echo")
+		waiting <- err
+	}()
+	select {
+	case err := <-waiting:
+		t.Errorf("call over limit not blocked got %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	if err := WaitAll(ctx, f1, f2, f3); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-waiting; err != nil {
+		t.Errorf("blocked call got %v", err)
+	}
+	for _, c := range []*Cluster{failFast, blocking} {
+		for _, s := range c.Stats().Senders {
+			if s.InFlight != 0 || s.QueuedBytes != 0 {
+				t.Errorf("stats after done got %+v", s)
+			}
+		}
+	}
+}
+
+func TestLimiterQueuedBytes(t *testing.T) {
+	l := &limiter{maxQueued: 10, policy: OverloadFail}
+	ctx := context.Background()
+	if err := l.acquire(ctx, 0, 6); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.acquire(ctx, 0, 5); !errors.Is(err, ErrOverloaded) {
+		t.Errorf("acquire over limit got %v", err)
+	}
+	l.release(0, 6)
+	// 队列为空时超过限制的单个请求也可以发送
+	if err := l.acquire(ctx, 0, 20); err != nil {
+		t.Errorf("acquire large on empty queue got %v", err)
+	}
+
+	l.policy = OverloadBlock
+	done := make(chan error)
+	go func() {
+		done <- l.acquire(ctx, 0, 1)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("acquire not blocked got %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	l.release(0, 20)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
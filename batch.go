@@ -0,0 +1,141 @@
+package skynetclusterd
+
+import (
+	"context"
+
+	"github.com/changlongH/skynet_cluster/codec"
+	"github.com/cloudwego/netpoll"
+)
+
+// Batch 发送到同一个节点的一组请求, Flush 时编码到同一个 buffer 中一次写出, 不能并发使用
+//
+//	b := c.NewBatch("rank")
+//	for _, id := range ids {
+//		futures = append(futures, b.Call("leaderboard", "get", id))
+//	}
+//	err := b.Do(ctx)
+type Batch struct {
+	c       *Cluster
+	node    string
+	futures []*Future
+}
+
+func (c *Cluster) NewBatch(node string) *Batch {
+	return &Batch{
+		c:    c,
+		node: node,
+	}
+}
+
+func NewBatch(node string) *Batch {
+	return defaultCluster.NewBatch(node)
+}
+
+// Call 添加一个请求, 参数和结果同 CallAsync, Flush 之后 Future 才会完成
+func (b *Batch) Call(service, cmd string, args ...any) *Future {
+	if args == nil {
+		args = []any{}
+	}
+	pack := &codec.ReqPack{
+		Addr: codec.Addr{
+			Id:   0,
+			Name: service,
+		},
+		Cmd:  cmd,
+		Args: args,
+	}
+	f := newFuture(b.c, b.node, pack)
+	b.futures = append(b.futures, f)
+	return f
+}
+
+// Len 还未发送的请求数量
+func (b *Batch) Len() int {
+	return len(b.futures)
+}
+
+// Flush 发送所有添加的请求并清空 Batch, 每个请求的结果由各自的 Future 返回
+// ctx 同 CallAsync, 结束时还未收到回应的请求返回 ErrTimeout 或者 ctx.Err()
+func (b *Batch) Flush(ctx context.Context) {
+	futures := b.futures
+	b.futures = nil
+	if len(futures) == 0 {
+		return
+	}
+
+	ctxs := make([]context.Context, len(futures))
+	for i, f := range futures {
+		ctxs[i] = f.begin(ctx)
+	}
+	agent, err := b.c.senders.getNodeSenderAgent(ctx, b.node)
+	if err != nil {
+		for _, f := range futures {
+			f.complete(nil, err)
+		}
+		return
+	}
+
+	// 打包失败的请求单独返回错误, 不影响其他请求
+	packed := make([]int, 0, len(futures))
+	bytes := 0
+	for i, f := range futures {
+		if err := f.pack.Pack(); err != nil {
+			f.complete(nil, err)
+			continue
+		}
+		packed = append(packed, i)
+		bytes += f.pack.Size
+	}
+	if len(packed) == 0 {
+		return
+	}
+	if err := agent.limiter.acquire(ctx, len(packed), bytes); err != nil {
+		for _, i := range packed {
+			futures[i].complete(nil, err)
+		}
+		return
+	}
+
+	writer := netpoll.NewLinkBuffer()
+	posted := make([]int, 0, len(packed))
+	for _, i := range packed {
+		f := futures[i]
+		f.pack.Trace = b.c.outboundTraceTag(ctxs[i])
+		f.pack.Session = agent.sessions.add(&Request{callback: f.complete})
+		if err := codec.EncodeReq(writer, agent.withDeadline(ctxs[i], f.pack)); err != nil {
+			agent.sessions.remove(f.pack.Session)
+			agent.limiter.release(0, f.pack.Size)
+			bytes -= f.pack.Size
+			f.complete(nil, err)
+			continue
+		}
+		posted = append(posted, i)
+	}
+	if len(posted) == 0 {
+		return
+	}
+
+	select {
+	case <-agent.CloseCh:
+		// 同 post, WaitResponse 清理 session 之后登记的请求由这里返回
+		agent.limiter.release(0, bytes)
+		for _, i := range posted {
+			if _, ok := agent.sessions.remove(futures[i].pack.Session); ok {
+				futures[i].complete(nil, agent.closeErr)
+			}
+		}
+		return
+	default:
+		agent.write(writer, bytes)
+	}
+	for _, i := range posted {
+		futures[i].watch(ctxs[i], agent)
+	}
+}
+
+// Do Flush 并等待所有请求完成, 返回第一个失败的请求的错误 (按添加顺序)
+func (b *Batch) Do(ctx context.Context) error {
+	futures := b.futures
+	b.Flush(ctx)
+	return WaitAll(ctx, futures...)
+}
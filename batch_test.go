@@ -0,0 +1,94 @@
+package skynetclusterd
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// writeCounter 统计发送的次数
+type writeCounter struct {
+	noopMetrics
+	writes atomic.Int32
+}
+
+func (m *writeCounter) Bytes(node, direction string, n int) {
+	if direction == DirectionOut {
+		m.writes.Add(1)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	metrics := &writeCounter{}
+	server, client := New(), New(WithMetrics(metrics))
+	addr := listenTestCluster(t, server)
+	client.RegisterNode("server", addr)
+	defer client.Shutdown(context.Background())
+	defer server.Shutdown(context.Background())
+
+	svc := NewService("rank")
+	svc.HandleMulti("get", func(ctx context.Context, args []any) ([]any, error) {
+		if args[0] == int64(-1) {
+			return nil, errors.New("not found")
+		}
+		return []any{args[0].(int64) * 10}, nil
+	})
+	server.RegisterService(svc)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	const n = 100
+	b := client.NewBatch("server")
+	futures := make([]*Future, n)
+	for i := range futures {
+		futures[i] = b.Call("rank", "get", int64(i))
+	}
+	if b.Len() != n {
+		t.Fatalf("batch len got %d", b.Len())
+	}
+	if err := b.Do(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() != 0 {
+		t.Errorf("batch len after Do got %d", b.Len())
+	}
+	if writes := metrics.writes.Load(); writes != 1 {
+		t.Errorf("batch writes got %d", writes)
+	}
+	for i, f := range futures {
+		results, err := f.Wait(ctx)
+		if err != nil || len(results) != 1 || results[0] != int64(i*10) {
+			t.Errorf("call %d got %v %v", i, results, err)
+		}
+	}
+
+	// 编码失败和远端错误只影响对应的请求
+	bad := b.Call("rank", "get", make(chan int))
+	notFound := b.Call("rank", "get", int64(-1))
+	ok := b.Call("rank", "get", int64(1))
+	var remoteErr *RemoteError
+	if err := b.Do(ctx); err == nil || errors.As(err, &remoteErr) {
+		t.Errorf("batch Do got %v", err)
+	}
+	if _, err := notFound.Wait(ctx); !errors.As(err, &remoteErr) || remoteErr.Message != "not found" {
+		t.Errorf("not found got %v", err)
+	}
+	if results, err := ok.Wait(ctx); err != nil || results[0] != int64(10) {
+		t.Errorf("ok got %v %v", results, err)
+	}
+	if _, err := bad.Wait(ctx); err == nil {
+		t.Error("encode error expected")
+	}
+
+	b = client.NewBatch("nobody")
+	f := b.Call("rank", "get", int64(1))
+	if err := b.Do(ctx); !errors.Is(err, ErrNodeNotFound) {
+		t.Errorf("unknown node got %v", err)
+	}
+	if _, err := f.Wait(ctx); !errors.Is(err, ErrNodeNotFound) {
+		t.Errorf("unknown node future got %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package skynetclusterd
+
+import (
+	"time"
+
+	"github.com/changlongH/skynet_cluster/codec"
+)
+
+const (
+	cancelQueueSize = 64
+)
+
+// cancel ctx 结束时移除 session, 通知 WaitResponse 释放还未收完的 multi part 回应
+// 返回 false 表示请求已经完成
+func (agent *SenderAgent) cancel(session uint32) bool {
+	if _, ok := agent.sessions.remove(session); !ok {
+		return false
+	}
+	select {
+	case agent.cancelCh <- session:
+	default:
+		// 通知满时由 discard 在收到后续的包时释放
+	}
+	return true
+}
+
+// freePartial 在 WaitResponse 中释放已经取消的请求的 multi part 回应, 后续的包直接丢弃
+func (agent *SenderAgent) freePartial(session uint32) {
+	if resp, ok := agent.LargeResponse[session]; ok {
+		delete(agent.LargeResponse, session)
+		resp.Release()
+		agent.discarded[session] = time.Now()
+	}
+}
+
+// discard 已经取消的请求的 multi part 回应不再保存, 返回 true 时丢弃这个包
+func (agent *SenderAgent) discard(session uint32, typ codec.RetType) bool {
+	switch typ {
+	case codec.RespTypeMBegin:
+		if !agent.sessions.has(session) {
+			agent.discarded[session] = time.Now()
+			return true
+		}
+	case codec.RespTypeMPart, codec.RespTypeMEnd:
+		if _, ok := agent.discarded[session]; !ok {
+			if _, partial := agent.LargeResponse[session]; partial {
+				if agent.sessions.has(session) {
+					return false
+				}
+				agent.freePartial(session)
+			}
+			// 没有开始部分的包: 丢弃记录已经超时清理, 按 late 丢弃, 不关闭链接
+		}
+		if typ == codec.RespTypeMEnd {
+			delete(agent.discarded, session)
+			agent.late(session)
+		}
+		return true
+	}
+	return false
+}
+
+// late 统计取消之后才收到的回应
+func (agent *SenderAgent) late(session uint32) {
+	agent.mgr.c.metrics.LateResponse(agent.Name)
+	agent.logger.Debug("drop late response", "session", session)
+}
@@ -0,0 +1,113 @@
+package skynetclusterd
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/changlongH/skynet_cluster/codec"
+	"github.com/cloudwego/netpoll"
+)
+
+// lateCounter 统计丢弃的回应
+type lateCounter struct {
+	noopMetrics
+	late atomic.Int32
+}
+
+func (m *lateCounter) LateResponse(node string) {
+	m.late.Add(1)
+}
+
+// TestCancelLargeResponse 取消的请求的 multi part 回应在收到时释放, 不影响链接上的其他请求
+func TestCancelLargeResponse(t *testing.T) {
+	testCancelLargeResponse(t, 0)
+}
+
+// TestCancelLargeResponseExpired 丢弃记录超时清理之后收到的剩余部分按 late 丢弃
+func TestCancelLargeResponseExpired(t *testing.T) {
+	testCancelLargeResponse(t, time.Millisecond*50)
+}
+
+func testCancelLargeResponse(t *testing.T, partialTimeout time.Duration) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	release := make(chan struct{})
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		large := map[uint32]*codec.ReqPack{}
+		for {
+			header := make([]byte, 2)
+			if _, err := io.ReadFull(conn, header); err != nil {
+				return
+			}
+			body := make([]byte, binary.BigEndian.Uint16(header))
+			if _, err := io.ReadFull(conn, body); err != nil {
+				return
+			}
+			pkg := netpoll.NewLinkBuffer()
+			pkg.WriteBinary(body)
+			pkg.Flush()
+			msg, err := codec.DecodeReq(pkg, large)
+			if err != nil || msg == nil {
+				continue
+			}
+			buf := netpoll.NewLinkBuffer()
+			if msg.Cmd == "big" {
+				// 先发送一半, 请求取消之后再发送剩下的部分
+				codec.EncodeResp(buf, &codec.RespPack{Session: msg.Session, Ok: true,
+					Results: []any{strings.Repeat("x", int(codec.PartSize)*3)}})
+				data, _ := buf.Next(buf.Len())
+				conn.Write(data[:len(data)/2])
+				<-release
+				conn.Write(data[len(data)/2:])
+				continue
+			}
+			codec.EncodeResp(buf, &codec.RespPack{Session: msg.Session, Ok: true, Results: []any{"ok"}})
+			data, _ := buf.Next(buf.Len())
+			conn.Write(data)
+		}
+	}()
+
+	metrics := &lateCounter{}
+	client := New(WithMetrics(metrics), WithPartialTimeout(partialTimeout))
+	client.RegisterNode("skynet", ln.Addr().String())
+	defer client.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	if _, err := client.CallMulti(ctx, "skynet", "db", "big"); !errors.Is(err, ErrTimeout) &&
+		!errors.Is(err, codec.ErrPartialExpired) {
+		t.Fatalf("call big got %v", err)
+	}
+	if partialTimeout > 0 {
+		time.Sleep(partialTimeout * 4)
+	}
+	close(release)
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	if results, err := client.CallMulti(ctx, "skynet", "db", "get"); err != nil || results[0] != "ok" {
+		t.Fatalf("call after cancel got %v %v", results, err)
+	}
+	if n := metrics.late.Load(); n != 1 {
+		t.Errorf("late responses got %d want 1", n)
+	}
+	agent, _ := client.senders.getNodeSenderAgent(ctx, "skynet")
+	if agent.InFlight() != 0 || len(agent.LargeResponse) != 0 {
+		t.Errorf("agent got inflight %d partial %d", agent.InFlight(), len(agent.LargeResponse))
+	}
+}
@@ -0,0 +1,128 @@
+package skynetclusterd
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/changlongH/skynet_cluster/codec"
+	"github.com/cloudwego/netpoll"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type (
+	// Option 创建 Cluster 时的可选配置
+	Option func(*Cluster)
+
+	// Cluster 一个 cluster 节点, 包含节点表, 到其他节点的链接, 本地服务和监听
+	// 同一个进程可以创建多个 Cluster, 包级别的 Call/Send/RegisterNode/Open 等函数使用默认的 Cluster
+	Cluster struct {
+		nodes    *nodeRegister
+		senders  *SenderMgr
+		services *serviceRegister
+
+		dialTimeout       time.Duration
+		minBackoff        time.Duration
+		maxBackoff        time.Duration
+		drainTimeout      time.Duration
+		readTimeout       time.Duration
+		poolSize          int
+		poolPolicy        PoolPolicy
+		largeConn         bool
+		maxInFlight       int
+		maxQueued         int
+		overloadPolicy    OverloadPolicy
+		mailboxSize       int
+		mailboxPolicy     OverloadPolicy
+		propagateDeadline bool
+		limits            codec.Limits
+		partialTimeout    time.Duration
+		tracer            trace.Tracer
+		traceparentTags   bool
+		metrics           Metrics
+		logger            *slog.Logger
+
+		mu        sync.Mutex
+		closed    bool
+		listener  netpoll.Listener
+		eventLoop netpoll.EventLoop
+		receivers map[*RecvAgent]struct{}
+	}
+)
+
+const (
+	defaultDialTimeout  = time.Second * 5
+	defaultMinBackoff   = time.Millisecond * 100
+	defaultMaxBackoff   = time.Second * 5
+	defaultDrainTimeout = time.Second * 10
+	defaultReadTimeout  = time.Second
+)
+
+var defaultCluster = New()
+
+// Default 返回包级别函数使用的 Cluster
+func Default() *Cluster {
+	return defaultCluster
+}
+
+func New(opts ...Option) *Cluster {
+	c := &Cluster{
+		nodes:          newNodeRegister(),
+		services:       newServiceRegister(),
+		dialTimeout:    defaultDialTimeout,
+		minBackoff:     defaultMinBackoff,
+		maxBackoff:     defaultMaxBackoff,
+		drainTimeout:   defaultDrainTimeout,
+		readTimeout:    defaultReadTimeout,
+		poolSize:       1,
+		mailboxSize:    defaultMailboxSize,
+		partialTimeout: defaultPartialTimeout,
+		tracer:         defaultTracer(),
+		metrics:        noopMetrics{},
+		receivers:      make(map[*RecvAgent]struct{}),
+	}
+	c.senders = newSenderMgr(c)
+	for _, opt := range opts {
+		opt(c)
+	}
+	if b, ok := c.metrics.(metricsBinder); ok {
+		b.bind(c)
+	}
+	return c
+}
+
+// WithNoWaiting 对应 clustername.lua 中的 __nowaiting, 默认为 true
+func WithNoWaiting(nowaiting bool) Option {
+	return func(c *Cluster) {
+		c.nodes.nowaiting = nowaiting
+	}
+}
+
+// WithDialTimeout 建立链接的超时时间, 默认 5s
+func WithDialTimeout(d time.Duration) Option {
+	return func(c *Cluster) {
+		c.dialTimeout = d
+	}
+}
+
+// WithBackoff 建立链接连续失败时的退避时间范围, 默认 100ms ~ 5s
+func WithBackoff(min, max time.Duration) Option {
+	return func(c *Cluster) {
+		c.minBackoff = min
+		c.maxBackoff = max
+	}
+}
+
+// WithDrainTimeout 节点移除后等待链接上的请求完成的最长时间, 默认 10s
+func WithDrainTimeout(d time.Duration) Option {
+	return func(c *Cluster) {
+		c.drainTimeout = d
+	}
+}
+
+// WithReadTimeout 监听链接的读超时时间, 默认 1s
+func WithReadTimeout(d time.Duration) Option {
+	return func(c *Cluster) {
+		c.readTimeout = d
+	}
+}
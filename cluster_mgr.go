@@ -1,137 +1,435 @@
 package skynetclusterd
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/changlongH/skynet_cluster/codec"
 	"github.com/cloudwego/netpoll"
 	"github.com/cloudwego/netpoll/mux"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type (
 	RecvAgent struct {
-		conn    netpoll.Connection
-		wqueue  *mux.ShardQueue // use for write
-		CloseCh chan struct{}
+		c         *Cluster
+		logger    *slog.Logger
+		conn      netpoll.Connection
+		wqueue    *mux.ShardQueue // use for write
+		CloseCh   chan struct{}
+		closeOnce sync.Once
+		drainCh   chan context.Context // Shutdown 时发送, 处理完已经收到的请求后退出
+		done      chan struct{}        // Start 退出时关闭
+
+		// handler 的 ctx, 链接关闭或者 Shutdown 超时后取消
+		ctx    context.Context
+		cancel context.CancelFunc
+
+		drained   int            // drain 时处理完成的请求包
+		abandoned int            // drain 超时未处理的请求包
+		pending   sync.WaitGroup // 放入 mailbox 还未处理完的请求
+		mailed    atomic.Int32   // 同 pending, 用于 drain 统计
+		queued    int            // Shutdown 开始时 mailbox 中还未处理完的请求
+		mailboxes map[*Service]*mailbox
 
 		Recv         chan netpoll.Reader // 接收网络包
 		LargeRequest map[uint32]*codec.ReqPack
+		trace        string // 等待中的 trace tag, 由下一个请求使用, 不计入 LargeRequest
 	}
 
 	nodeRegister struct {
 		sync.RWMutex
-		register map[string]string // name -> addr and addr -> name
+		register  map[string]string // name -> addr and addr -> name
+		down      map[string]bool   // clustername.lua 中 node = false 的节点
+		nowaiting bool              // 节点不存在或者下线时是否立即返回错误
+		changed   chan struct{}     // 注册信息变化时关闭并重新创建, 用于唤醒等待节点的请求
 	}
 )
 
-var (
-	clusterReg = nodeRegister{
-		register: make(map[string]string),
+func newNodeRegister() *nodeRegister {
+	return &nodeRegister{
+		register:  make(map[string]string),
+		down:      make(map[string]bool),
+		nowaiting: true,
+		changed:   make(chan struct{}),
 	}
-)
+}
+
+// notify 唤醒等待节点注册的请求, 调用前需要持有写锁
+func (reg *nodeRegister) notify() {
+	close(reg.changed)
+	reg.changed = make(chan struct{})
+}
+
+// set 注册节点, 返回节点地址是否发生变化
+func (reg *nodeRegister) set(name, addr string) bool {
+	reg.Lock()
+	defer reg.Unlock()
+	old, changed := reg.register[name]
+	if changed {
+		changed = old != addr
+		delete(reg.register, old)
+	}
+	delete(reg.down, name)
+	reg.register[name] = addr
+	reg.register[addr] = name
+	reg.notify()
+	return changed
+}
+
+// remove 移除节点, down 为 true 时标记为下线, 返回节点之前是否已注册
+func (reg *nodeRegister) remove(name string, down bool) bool {
+	reg.Lock()
+	defer reg.Unlock()
+	addr, ok := reg.register[name]
+	if ok {
+		delete(reg.register, addr)
+	}
+	delete(reg.register, name)
+	if down {
+		reg.down[name] = true
+	} else {
+		delete(reg.down, name)
+	}
+	reg.notify()
+	return ok
+}
+
+func (reg *nodeRegister) isDown(name string) bool {
+	reg.RLock()
+	defer reg.RUnlock()
+	return reg.down[name]
+}
+
+func (reg *nodeRegister) setNoWaiting(nowaiting bool) {
+	reg.Lock()
+	defer reg.Unlock()
+	reg.nowaiting = nowaiting
+	reg.notify()
+}
+
+func (reg *nodeRegister) addr(name string) (string, bool) {
+	reg.RLock()
+	defer reg.RUnlock()
+	addr, ok := reg.register[name]
+	return addr, ok
+}
+
+// waitAddr 获取节点地址, 非 nowaiting 模式下等待节点注册
+func (reg *nodeRegister) waitAddr(ctx context.Context, name string) (string, error) {
+	for {
+		reg.RLock()
+		addr, ok := reg.register[name]
+		down := reg.down[name]
+		nowaiting := reg.nowaiting
+		changed := reg.changed
+		reg.RUnlock()
+
+		if ok {
+			return addr, nil
+		}
+		if nowaiting {
+			if down {
+				return "", fmt.Errorf("%w:%s", ErrNodeDown, name)
+			}
+			return "", fmt.Errorf("%w:%s", ErrNodeNotFound, name)
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return "", ctxErr(ctx)
+		}
+	}
+}
 
 // "test": "192.168.1.195:6001"
+// 地址发生变化时关闭已经建立的链接, 等待中的请求返回 ErrNodeChanged
+func (c *Cluster) RegisterNode(name string, addr string) {
+	if c.nodes.set(name, addr) {
+		c.senders.closeNode(name, ErrNodeChanged)
+	}
+}
+
 func RegisterNode(name string, addr string) {
-	clusterReg.Lock()
-	defer clusterReg.Unlock()
-	clusterReg.register[name] = addr
-	clusterReg.register[addr] = name
+	defaultCluster.RegisterNode(name, addr)
+}
+
+// UnRegisterNode 移除节点, 已经建立的链接等待中的请求完成后关闭
+func (c *Cluster) UnRegisterNode(name string) {
+	if c.nodes.remove(name, false) {
+		c.senders.drainNode(name, c.drainTimeout)
+	}
 }
 
 func UnRegisterNode(name string) {
-	clusterReg.Lock()
-	defer clusterReg.Unlock()
+	defaultCluster.UnRegisterNode(name)
+}
 
-	if addr, ok := clusterReg.register[name]; ok {
-		delete(clusterReg.register, addr)
+// SetNodeDown 标记节点下线, 对应 clustername.lua 中的 node = false
+// 已经建立的链接会被关闭, 等待中的请求返回 ErrNodeDown
+func (c *Cluster) SetNodeDown(name string) {
+	if c.nodes.remove(name, true) {
+		c.senders.closeNode(name, ErrNodeDown)
 	}
-	delete(clusterReg.register, name)
+}
+
+func SetNodeDown(name string) {
+	defaultCluster.SetNodeDown(name)
+}
+
+// IsNodeDown 节点是否被标记为下线
+func (c *Cluster) IsNodeDown(name string) bool {
+	return c.nodes.isDown(name)
+}
+
+func IsNodeDown(name string) bool {
+	return defaultCluster.IsNodeDown(name)
+}
+
+// SetNoWaiting 对应 clustername.lua 中的 __nowaiting
+// 为 false 时请求不存在或者下线的节点会阻塞到节点注册 (受 ctx 控制), 默认为 true
+func (c *Cluster) SetNoWaiting(nowaiting bool) {
+	c.nodes.setNoWaiting(nowaiting)
+}
+
+func SetNoWaiting(nowaiting bool) {
+	defaultCluster.SetNoWaiting(nowaiting)
+}
+
+func (c *Cluster) GetRegisterNodeAddr(name string) (string, bool) {
+	return c.nodes.addr(name)
 }
 
 func GetRegisterNodeAddr(name string) (string, bool) {
-	clusterReg.RLock()
-	defer clusterReg.RUnlock()
-	addr, ok := clusterReg.register[name]
-	return addr, ok
+	return defaultCluster.GetRegisterNodeAddr(name)
 }
 
-// TODO: reload addr 需要changenode 对于已建立的链接处理
-func ReloadConfig(conf map[string]string) {
+func (c *Cluster) ReloadConfig(conf map[string]string) {
 	for name, addr := range conf {
-		RegisterNode(name, addr)
+		c.RegisterNode(name, addr)
 	}
 }
 
-func NewRecvAgent(conn netpoll.Connection) *RecvAgent {
+func ReloadConfig(conf map[string]string) {
+	defaultCluster.ReloadConfig(conf)
+}
+
+func (c *Cluster) newRecvAgent(conn netpoll.Connection) *RecvAgent {
 	agent := &RecvAgent{
+		c:            c,
+		logger:       c.log().With("remote_addr", conn.RemoteAddr().String()),
 		conn:         conn,
 		wqueue:       mux.NewShardQueue(mux.ShardSize, conn),
 		Recv:         make(chan netpoll.Reader, 1000),
 		CloseCh:      make(chan struct{}),
+		drainCh:      make(chan context.Context, 1),
+		done:         make(chan struct{}),
 		LargeRequest: make(map[uint32]*codec.ReqPack),
+		mailboxes:    make(map[*Service]*mailbox),
 	}
+	agent.ctx, agent.cancel = context.WithCancel(context.Background())
+	c.mu.Lock()
+	c.receivers[agent] = struct{}{}
+	c.mu.Unlock()
 	go agent.Start()
 
-	//remoteAddr := conn.RemoteAddr().String()
+	agent.logger.Debug("accept connection")
 	return agent
 }
 
+// NewRecvAgent 创建的 agent 把请求分发给默认 Cluster 的服务
+func NewRecvAgent(conn netpoll.Connection) *RecvAgent {
+	return defaultCluster.newRecvAgent(conn)
+}
+
 func (agent *RecvAgent) Response(msg *codec.RespPack) {
 	writer := netpoll.NewLinkBuffer()
 	err := codec.EncodeResp(writer, msg)
 	if err != nil {
-		return
+		agent.logger.Error("encode response failed", "session", msg.Session, "error", err)
+		if !msg.Ok {
+			return
+		}
+		// 返回值无法打包时回复错误, 避免对方一直等待
+		writer = netpoll.NewLinkBuffer()
+		err = codec.EncodeResp(writer, &codec.RespPack{
+			Session: msg.Session,
+			Ok:      false,
+			Message: []byte(err.Error()),
+		})
+		if err != nil {
+			return
+		}
 	}
+	agent.c.metrics.Bytes("", DirectionOut, bufferSize(writer))
 
 	// Put puts the buffer getter back to the queue.
 	agent.wqueue.Add(func() (buf netpoll.Writer, isNil bool) {
+		// 链接关闭后 Append 会 panic, 导致 wqueue.Close 无法返回
+		if !agent.conn.IsActive() {
+			return nil, true
+		}
 		return writer, false
 	})
 }
 
+// dispatch 把请求交给注册的服务处理, session 为 0 (push) 时不回复
+// deadline 非零时 handler 的 ctx 在调用方放弃等待时结束, 已经超时的请求不再处理
+func (agent *RecvAgent) dispatch(msg *codec.ReqPack, deadline time.Time) {
+	kind := trace.SpanKindServer
+	if msg.Session == 0 {
+		kind = trace.SpanKindConsumer
+	}
+	ctx := inboundContext(agent.ctx, msg.Trace)
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	start := time.Now()
+	ctx, span := agent.c.startSpan(ctx, kind, msg)
+	if span.IsRecording() {
+		span.SetAttributes(attrPeer.String(agent.conn.RemoteAddr().String()))
+	}
+	setSpanPack(span, msg)
+	var resp *codec.RespPack
+	err := ctx.Err()
+	if err != nil {
+		err = ctxErr(ctx)
+	} else {
+		resp, err = agent.c.dispatch(ctx, msg)
+	}
+	endSpan(span, err)
+	agent.c.metrics.Dispatched(serviceName(msg.Addr), msg.Cmd, time.Since(start), err)
+	if err != nil {
+		agent.logger.Debug("handle request failed", "service", serviceName(msg.Addr), "cmd", msg.Cmd,
+			"session", msg.Session, "error", err)
+	}
+	if msg.Session == 0 {
+		return
+	}
+	if err != nil {
+		agent.Response(&codec.RespPack{
+			Session: msg.Session,
+			Ok:      false,
+			Message: []byte(err.Error()),
+		})
+		return
+	}
+	resp.Session = msg.Session
+	resp.Ok = true
+	agent.Response(resp)
+}
+
+// Close 关闭链接, 未处理的请求被丢弃
+func (agent *RecvAgent) Close() {
+	agent.closeOnce.Do(func() {
+		close(agent.CloseCh)
+	})
+}
+
 func (agent *RecvAgent) Start() {
 	defer func() {
 		if err := recover(); err != nil {
+			agent.logger.Error("recv agent panic", "panic", err, "stack", string(debug.Stack()))
 			if agent.conn.IsActive() {
 				agent.conn.Close()
 			}
 		}
+		agent.logger.Debug("connection closed", "pending", len(agent.Recv), "partial", len(agent.LargeRequest))
+		agent.cancel()
+		agent.closeMailboxes()
+		agent.c.mu.Lock()
+		delete(agent.c.receivers, agent)
+		agent.c.mu.Unlock()
+		close(agent.done)
 	}()
 
-	var err error
-	var msg *codec.ReqPack
+	sweeper := agent.c.newSweeper()
+	if sweeper != nil {
+		defer sweeper.Stop()
+	}
 	for {
+		// Shutdown 优先, drain 时统计已经收到的请求
 		select {
-		case pkg := <-agent.Recv:
-			msg, err = codec.DecodeReq(pkg, agent.LargeRequest)
-			if err != nil {
-				if msg != nil && msg.Session > 0 {
-					agent.Response(&codec.RespPack{
-						Session: msg.Session,
-						Ok:      false,
-						Message: []byte(err.Error()),
-					})
-				}
-				continue
-			}
+		case ctx := <-agent.drainCh:
+			agent.drain(ctx)
+			return
+		default:
+		}
 
-			if msg != nil {
-				// TODO: 消息分发
-				//args := msg.Message
-				msg.Message = []byte{}
-				if msg.Session > 0 {
-					text := fmt.Sprintf("recv msg addr:{%d:%s} session:%d", msg.Addr.Id, msg.Addr.Name, msg.Session)
-					resp := &codec.RespPack{
-						Session: msg.Session,
-						Ok:      true,
-						Message: []byte(text),
-					}
-					agent.Response(resp)
-				}
-			}
+		select {
+		case pkg := <-agent.Recv:
+			agent.process(pkg)
+		case ctx := <-agent.drainCh:
+			agent.drain(ctx)
+			return
+		case now := <-sweepC(sweeper):
+			agent.expire(now)
 		case <-agent.CloseCh:
 			return
 		}
 	}
 }
+
+func (agent *RecvAgent) process(pkg netpoll.Reader) {
+	header, _ := pkg.Peek(1)
+	msg, err := codec.DecodeReqWithLimits(pkg, agent.LargeRequest, &agent.trace, agent.c.limits)
+	if err != nil {
+		attrs := []any{"error", err}
+		if len(header) == 1 {
+			agent.c.metrics.DecodeError("", header[0])
+			attrs = append(attrs, packetTypeAttr(header[0]))
+		}
+		if msg != nil {
+			attrs = append(attrs, "session", msg.Session)
+		}
+		agent.logger.Warn("decode request failed", attrs...)
+		if msg != nil && msg.Session > 0 {
+			agent.Response(&codec.RespPack{
+				Session: msg.Session,
+				Ok:      false,
+				Message: []byte(err.Error()),
+			})
+		}
+		return
+	}
+
+	if msg != nil {
+		if msg.Multipart() {
+			agent.c.metrics.Multipart("")
+		}
+		deadline := parseDeadline(msg)
+		if !agent.deliver(msg, deadline) {
+			agent.dispatch(msg, deadline)
+		}
+	}
+}
+
+// drain 处理已经收到的请求, 等待回应发送完成后关闭链接
+// ctx 结束后剩下的请求和未收完的 multi part 请求被丢弃
+func (agent *RecvAgent) drain(ctx context.Context) {
+	for n := len(agent.Recv); n > 0; n-- {
+		if ctx.Err() != nil {
+			agent.abandoned += n
+			break
+		}
+		agent.process(<-agent.Recv)
+		agent.drained++
+	}
+	agent.abandoned += len(agent.LargeRequest)
+	// 等待 mailbox 中的请求处理完成, 超时后 Shutdown 取消 ctx, 剩下的请求不再处理
+	agent.wait(ctx)
+	left := int(agent.mailed.Load())
+	agent.drained += max(agent.queued-left, 0)
+	agent.abandoned += left
+	if agent.conn.IsActive() {
+		agent.wqueue.Close()
+		agent.conn.Close()
+	}
+}
@@ -0,0 +1,250 @@
+package skynetclusterd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/changlongH/skynet_cluster/codec"
+)
+
+// startTestNode 在本地随机端口启动一个 cluster 节点, 并注册为 name
+func startTestNode(t *testing.T, name string) string {
+	t.Helper()
+	addr := listenTestCluster(t, Default())
+	RegisterNode(name, addr)
+	return addr
+}
+
+// listenTestCluster 在本地随机端口启动 c 的监听
+func listenTestCluster(t *testing.T, c *Cluster) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	go c.Open(addr)
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return addr
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("listen %s timeout", addr)
+	return ""
+}
+
+func TestDispatch(t *testing.T) {
+	startTestNode(t, "dispatch")
+
+	svc := NewService("echo")
+	svc.Handle("echo", func(ctx context.Context, args []byte) ([]byte, error) {
+		return args, nil
+	})
+	svc.Handle("fail", func(ctx context.Context, args []byte) ([]byte, error) {
+		return nil, errors.New("fail:" + string(args))
+	})
+	RegisterService(svc)
+	defer UnRegisterService("echo")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	cases := []struct {
+		service, cmd, args string
+		ok                 bool
+		resp               string
+	}{
+		{"echo", "echo", "hello", true, "hello"},
+		{"@echo", "echo", "hello", true, "hello"},
+		{"echo", "fail", "oops", false, "fail:oops"},
+		{"echo", "none", "", false, "unknown cmd:none service:echo"},
+		{"nobody", "echo", "", false, "unknown service name:nobody"},
+	}
+	for _, c := range cases {
+		ok, resp := Call(ctx, "dispatch", c.service, c.cmd, c.args)
+		if ok != c.ok || resp != c.resp {
+			t.Errorf("call %s.%s got (%v, %q) want (%v, %q)", c.service, c.cmd, ok, resp, c.ok, c.resp)
+		}
+	}
+}
+
+func TestCallMulti(t *testing.T) {
+	startTestNode(t, "multi")
+
+	svc := NewService("multi")
+	svc.HandleMulti("swap", func(ctx context.Context, args []any) ([]any, error) {
+		results := make([]any, len(args))
+		for i, v := range args {
+			results[len(args)-1-i] = v
+		}
+		return results, nil
+	})
+	svc.HandleMulti("none", func(ctx context.Context, args []any) ([]any, error) {
+		return nil, nil
+	})
+	RegisterService(svc)
+	defer UnRegisterService("multi")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	// 超过 PartSize 的参数和返回值走 multi part
+	large := strings.Repeat("x", int(codec.PartSize)*3+7)
+	args := []any{int64(1), 2.5, true, "str", large, &codec.Table{Array: []any{int64(1), int64(2)}}}
+	results, err := CallMulti(ctx, "multi", "multi", "swap", args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]any, len(args))
+	for i, v := range args {
+		want[len(args)-1-i] = v
+	}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("swap got %v", results)
+	}
+
+	results, err = CallMulti(ctx, "multi", "multi", "none")
+	if err != nil || len(results) != 0 {
+		t.Errorf("none got %v %v", results, err)
+	}
+}
+
+func TestCallTyped(t *testing.T) {
+	startTestNode(t, "typed")
+
+	type (
+		query struct {
+			Id   int64  `lua:"id"`
+			Name string `lua:"name"`
+		}
+		player struct {
+			Id    int64    `lua:"id"`
+			Name  string   `lua:"name"`
+			Items []string `lua:"items"`
+		}
+	)
+
+	svc := NewService("db")
+	svc.HandleMulti("load", func(ctx context.Context, args []any) ([]any, error) {
+		var q query
+		if err := codec.FromLua(args[0], &q); err != nil {
+			return nil, err
+		}
+		if q.Id == 0 {
+			return nil, errors.New("invalid id")
+		}
+		return []any{player{Id: q.Id, Name: q.Name, Items: []string{"sword"}}}, nil
+	})
+	RegisterService(svc)
+	defer UnRegisterService("db")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	p, err := CallTyped[query, player](ctx, "typed", "db", "load", query{Id: 1, Name: "go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Id != 1 || p.Name != "go" || !reflect.DeepEqual(p.Items, []string{"sword"}) {
+		t.Errorf("load got %+v", p)
+	}
+
+	_, err = CallTyped[query, player](ctx, "typed", "db", "load", query{})
+	var remoteErr *RemoteError
+	if !errors.As(err, &remoteErr) || remoteErr.Message != "invalid id" {
+		t.Errorf("load got err %v", err)
+	}
+
+	_, err = CallTyped[query, player](ctx, "nonexist", "db", "load", query{})
+	if !errors.Is(err, ErrNodeNotFound) {
+		t.Errorf("call nonexist node got err %v", err)
+	}
+}
+
+func TestNewCluster(t *testing.T) {
+	a, b := New(), New(WithDialTimeout(time.Second))
+	addrA := listenTestCluster(t, a)
+	addrB := listenTestCluster(t, b)
+	defer a.Shutdown(context.Background())
+	defer b.Shutdown(context.Background())
+
+	a.RegisterNode("b", addrB)
+	b.RegisterNode("a", addrA)
+
+	for _, c := range []*Cluster{a, b} {
+		c := c
+		svc := NewService("whoami")
+		svc.Handle("name", func(ctx context.Context, args []byte) ([]byte, error) {
+			if c == a {
+				return []byte("a"), nil
+			}
+			return []byte("b"), nil
+		})
+		c.RegisterService(svc)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	if ok, resp := a.Call(ctx, "b", "whoami", "name", ""); !ok || resp != "b" {
+		t.Errorf("a call b got (%v, %q)", ok, resp)
+	}
+	if ok, resp := b.Call(ctx, "a", "whoami", "name", ""); !ok || resp != "a" {
+		t.Errorf("b call a got (%v, %q)", ok, resp)
+	}
+
+	// 实例之间以及和默认实例之间的节点表和服务互不影响
+	if _, ok := GetRegisterNodeAddr("b"); ok {
+		t.Error("node b registered in default cluster")
+	}
+	if _, ok := GetService(codec.Addr{Name: "whoami"}); ok {
+		t.Error("service whoami registered in default cluster")
+	}
+	if _, err := a.CallMulti(ctx, "a", "whoami", "name"); !errors.Is(err, ErrNodeNotFound) {
+		t.Errorf("a call a got %v want %v", err, ErrNodeNotFound)
+	}
+}
+
+func TestTraceTag(t *testing.T) {
+	startTestNode(t, "trace")
+	startTestNode(t, "trace_next")
+
+	svc := NewService("trace")
+	svc.Handle("tag", func(ctx context.Context, args []byte) ([]byte, error) {
+		tag, _ := TraceTagFrom(ctx)
+		return []byte(tag), nil
+	})
+	// 转发请求时 trace tag 随 ctx 传递到下一个节点
+	svc.Handle("forward", func(ctx context.Context, args []byte) ([]byte, error) {
+		ok, resp := Call(ctx, "trace_next", "trace", "tag", "")
+		if !ok {
+			return nil, errors.New(resp)
+		}
+		return []byte(resp), nil
+	})
+	RegisterService(svc)
+	defer UnRegisterService("trace")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	if ok, resp := Call(ctx, "trace", "trace", "tag", ""); !ok || resp != "" {
+		t.Errorf("call without trace got (%v, %q)", ok, resp)
+	}
+	traced := WithTraceTag(ctx, ":0100000a-1")
+	for _, cmd := range []string{"tag", "forward"} {
+		if ok, resp := Call(traced, "trace", "trace", cmd, ""); !ok || resp != ":0100000a-1" {
+			t.Errorf("call %s got (%v, %q)", cmd, ok, resp)
+		}
+	}
+}
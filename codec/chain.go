@@ -0,0 +1,60 @@
+package codec
+
+import (
+	"github.com/cloudwego/netpoll"
+)
+
+// chain multi part 消息收到的部分, 不复制数据, 按顺序把每个包中的数据链接到同一个 LinkBuffer
+// 收完后直接从 LinkBuffer 解码, 引用的包在解码完成或者丢弃时释放
+type chain struct {
+	buf   *netpoll.LinkBuffer
+	parts []netpoll.Reader
+	size  int
+}
+
+func newChain() *chain {
+	return &chain{
+		buf: netpoll.NewLinkBuffer(),
+	}
+}
+
+// append 引用 pkg 中接下来的 n 字节
+func (c *chain) append(pkg netpoll.Reader, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	// Slice 持有网络包的引用, pkg Release 之后数据仍然有效
+	part, err := pkg.Slice(n)
+	if err != nil {
+		return err
+	}
+	p, err := part.Next(n)
+	if err != nil {
+		part.Release()
+		return err
+	}
+	c.parts = append(c.parts, part)
+	c.size += n
+	return c.buf.WriteDirect(p, 0)
+}
+
+// unpack 解码所有收到的数据并释放
+func (c *chain) unpack() ([]any, error) {
+	defer c.release()
+	if err := c.buf.Flush(); err != nil {
+		return nil, err
+	}
+	return UnpackReader(c.buf)
+}
+
+// release nil 时不做处理
+func (c *chain) release() {
+	if c == nil {
+		return
+	}
+	c.buf.Release()
+	for _, part := range c.parts {
+		part.Release()
+	}
+	c.parts = nil
+}
@@ -0,0 +1,72 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Limits 限制一个链接上正在接收的 multi part 消息, 零值不限制
+type Limits struct {
+	MaxSize    int // 单个消息的最大字节数
+	MaxPartial int // 同时未收完的消息数量
+}
+
+var (
+	ErrMessageTooLarge = errors.New("cluster message too large")
+	ErrTooManyPartial  = errors.New("too many partial cluster messages")
+	ErrPartialExpired  = errors.New("partial cluster message expired")
+	ErrDuplicatePart   = errors.New("duplicate multi part cluster message session")
+)
+
+// check 开始接收一个 size 字节的消息, partial 为正在接收的消息数量
+func (l Limits) check(size uint32, partial int) error {
+	if l.MaxPartial > 0 && partial >= l.MaxPartial {
+		return fmt.Errorf("%w (limit=%d)", ErrTooManyPartial, l.MaxPartial)
+	}
+	if l.MaxSize > 0 && int64(size) > int64(l.MaxSize) {
+		return fmt.Errorf("%w (size=%d limit=%d)", ErrMessageTooLarge, size, l.MaxSize)
+	}
+	return nil
+}
+
+// IsLimitError 是否为超过 Limits 或者接收超时的错误, 链接可以继续使用
+func IsLimitError(err error) bool {
+	return errors.Is(err, ErrMessageTooLarge) || errors.Is(err, ErrTooManyPartial) ||
+		errors.Is(err, ErrPartialExpired)
+}
+
+// ExpireLargeReq 丢弃 before 之前开始接收还未收完的 multi part 请求, 返回需要回复错误的请求
+// 丢弃的请求保留到下一次检查, 期间收到的部分直接忽略
+func ExpireLargeReq(largeReq map[uint32]*ReqPack, before time.Time) []*ReqPack {
+	var expired []*ReqPack
+	now := time.Now()
+	for session, req := range largeReq {
+		// 没有开始时间的是 DecodeReq 保存的 trace tag
+		if req.started.IsZero() || !req.started.Before(before) {
+			continue
+		}
+		if req.dropped {
+			delete(largeReq, session)
+			continue
+		}
+		req.drop(now)
+		if !req.push {
+			expired = append(expired, req.reply())
+		}
+	}
+	return expired
+}
+
+// ExpireLargeResp 移除 before 之前开始接收还未收完的 multi part 回应, 返回对应的 session
+func ExpireLargeResp(largeResp map[uint32]*RespPack, before time.Time) []uint32 {
+	var expired []uint32
+	for session, resp := range largeResp {
+		if resp.started.Before(before) {
+			delete(largeResp, session)
+			resp.Release()
+			expired = append(expired, session)
+		}
+	}
+	return expired
+}
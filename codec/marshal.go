@@ -0,0 +1,556 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// struct tag:
+//
+//	Name  string   `lua:"name"`           // 对应 t.name
+//	Level int      `lua:"level,omitempty"` // 零值时不打包
+//	Pos   Vector   `lua:"pos,array"`       // 子结构按字段顺序打包成数组 {x, y, z}
+//	Items []string `lua:"items,hash"`      // 数组打包成 {[1]=..., [2]=...}, 跳过 nil 元素
+//	Skip  int      `lua:"-"`               // 忽略
+type (
+	fieldInfo struct {
+		name      string
+		index     []int
+		omitEmpty bool
+		asArray   bool
+		asHash    bool
+	}
+
+	UnmarshalTypeError struct {
+		Value string
+		Type  reflect.Type
+	}
+)
+
+var (
+	fieldCache sync.Map // reflect.Type -> []fieldInfo
+
+	tableType = reflect.TypeOf(Table{})
+)
+
+func (e *UnmarshalTypeError) Error() string {
+	return fmt.Sprintf("cannot unmarshal lua %s into go value of type %s", e.Value, e.Type.String())
+}
+
+// Marshal 把 go 值转换成 lua 值并序列化, 结果可以被 skynet.unpack 解出
+func Marshal(v any) ([]byte, error) {
+	lv, err := ToLua(v)
+	if err != nil {
+		return nil, err
+	}
+	return Pack(lv)
+}
+
+// Unmarshal 反序列化 data 中的第一个 lua 值到 v, v 必须是非 nil 指针
+func Unmarshal(data []byte, v any) error {
+	values, err := Unpack(data)
+	if err != nil {
+		return err
+	}
+	var lv any
+	if len(values) > 0 {
+		lv = values[0]
+	}
+	return FromLua(lv, v)
+}
+
+// ToLua 把 go 值转换成可以直接 Pack 的 lua 值
+// struct/map/slice 转换成 *Table, []byte 转换成 string
+func ToLua(v any) (any, error) {
+	return toLua(reflect.ValueOf(v), fieldInfo{}, 0)
+}
+
+// FromLua 把 Unpack 得到的 lua 值赋值给 v, v 必须是非 nil 指针
+func FromLua(lv any, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return errors.New("unmarshal target must be a non-nil pointer")
+	}
+	return fromLua(lv, rv.Elem(), fieldInfo{}, 0)
+}
+
+func parseTag(field reflect.StructField) (fieldInfo, bool) {
+	info := fieldInfo{name: field.Name}
+	tag, ok := field.Tag.Lookup("lua")
+	if !ok {
+		return info, true
+	}
+	if tag == "-" {
+		return info, false
+	}
+	name, opts, _ := strings.Cut(tag, ",")
+	if name != "" {
+		info.name = name
+	}
+	for _, opt := range strings.Split(opts, ",") {
+		switch opt {
+		case "omitempty":
+			info.omitEmpty = true
+		case "array":
+			info.asArray = true
+		case "hash":
+			info.asHash = true
+		}
+	}
+	return info, true
+}
+
+func cachedFields(t reflect.Type) []fieldInfo {
+	if fields, ok := fieldCache.Load(t); ok {
+		return fields.([]fieldInfo)
+	}
+	fields := typeFields(t, nil)
+	fieldCache.Store(t, fields)
+	return fields
+}
+
+func typeFields(t reflect.Type, index []int) []fieldInfo {
+	fields := []fieldInfo{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		_, tagged := field.Tag.Lookup("lua")
+		// 匿名结构体没有 tag 时展开
+		if field.Anonymous && !tagged {
+			ft := field.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				if field.Type.Kind() == reflect.Pointer {
+					// 指针类型的匿名字段不展开, 避免分配
+					continue
+				}
+				fields = append(fields, typeFields(ft, append(index[:len(index):len(index)], i))...)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		info, ok := parseTag(field)
+		if !ok {
+			continue
+		}
+		info.index = append(index[:len(index):len(index)], i)
+		fields = append(fields, info)
+	}
+	return fields
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64,
+		reflect.Interface, reflect.Pointer:
+		return v.IsZero()
+	}
+	return false
+}
+
+func toLua(v reflect.Value, info fieldInfo, depth int) (any, error) {
+	if depth > MaxDepth {
+		return nil, ErrTooDepth
+	}
+	if !v.IsValid() {
+		return nil, nil
+	}
+
+	if v.CanInterface() {
+		switch val := v.Interface().(type) {
+		case *Table, LightUserData:
+			return val, nil
+		case Table:
+			return &val, nil
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		return v.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n := v.Uint()
+		if n > math.MaxInt64 {
+			return nil, fmt.Errorf("integer %d overflow lua integer", n)
+		}
+		return int64(n), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return toLua(v.Elem(), info, depth)
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil, nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return string(v.Bytes()), nil
+		}
+		return sliceToLua(v, info, depth)
+	case reflect.Array:
+		return sliceToLua(v, info, depth)
+	case reflect.Map:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return mapToLua(v, depth)
+	case reflect.Struct:
+		return structToLua(v, info, depth)
+	default:
+		return nil, fmt.Errorf("unsupport type %s to marshal", v.Type().String())
+	}
+}
+
+func sliceToLua(v reflect.Value, info fieldInfo, depth int) (any, error) {
+	t := &Table{}
+	n := v.Len()
+	if !info.asHash {
+		t.Array = make([]any, 0, n)
+	}
+	for i := 0; i < n; i++ {
+		lv, err := toLua(v.Index(i), fieldInfo{}, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		if info.asHash {
+			if lv != nil {
+				t.Set(int64(i+1), lv)
+			}
+			continue
+		}
+		t.Array = append(t.Array, lv)
+	}
+	return t, nil
+}
+
+func mapToLua(v reflect.Value, depth int) (any, error) {
+	t := &Table{Hash: make(map[any]any, v.Len())}
+	iter := v.MapRange()
+	for iter.Next() {
+		k, err := toLua(iter.Key(), fieldInfo{}, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		switch k.(type) {
+		case string, int64, float64, bool:
+		default:
+			return nil, fmt.Errorf("unsupport map key type %s to marshal", iter.Key().Type().String())
+		}
+		lv, err := toLua(iter.Value(), fieldInfo{}, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		if lv != nil {
+			t.Hash[k] = lv
+		}
+	}
+	return t, nil
+}
+
+func structToLua(v reflect.Value, info fieldInfo, depth int) (any, error) {
+	t := &Table{}
+	for _, field := range cachedFields(v.Type()) {
+		fv := v.FieldByIndex(field.index)
+		if info.asArray {
+			lv, err := toLua(fv, field, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			t.Array = append(t.Array, lv)
+			continue
+		}
+		if field.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		lv, err := toLua(fv, field, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		if lv != nil {
+			t.Set(field.name, lv)
+		}
+	}
+	return t, nil
+}
+
+func luaTypeName(lv any) string {
+	switch lv.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case int64, float64:
+		return "number"
+	case string:
+		return "string"
+	case *Table:
+		return "table"
+	case LightUserData:
+		return "lightuserdata"
+	default:
+		return fmt.Sprintf("%T", lv)
+	}
+}
+
+func fromLua(lv any, v reflect.Value, info fieldInfo, depth int) error {
+	if depth > MaxDepth {
+		return ErrTooDepth
+	}
+	if lv == nil {
+		v.SetZero()
+		return nil
+	}
+
+	typeErr := &UnmarshalTypeError{Value: luaTypeName(lv), Type: v.Type()}
+
+	if v.Type() == tableType {
+		if t, ok := lv.(*Table); ok {
+			v.Set(reflect.ValueOf(*t))
+			return nil
+		}
+		return typeErr
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.Type() == reflect.PointerTo(tableType) {
+			if t, ok := lv.(*Table); ok {
+				v.Set(reflect.ValueOf(t))
+				return nil
+			}
+			return typeErr
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return fromLua(lv, v.Elem(), info, depth)
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return typeErr
+		}
+		v.Set(reflect.ValueOf(plainValue(lv)))
+		return nil
+	case reflect.Bool:
+		b, ok := lv.(bool)
+		if !ok {
+			return typeErr
+		}
+		v.SetBool(b)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := luaInteger(lv)
+		if !ok || v.OverflowInt(n) {
+			return typeErr
+		}
+		v.SetInt(n)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if p, ok := lv.(LightUserData); ok {
+			lv = int64(p)
+		}
+		n, ok := luaInteger(lv)
+		if !ok || n < 0 || v.OverflowUint(uint64(n)) {
+			return typeErr
+		}
+		v.SetUint(uint64(n))
+		return nil
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		switch n := lv.(type) {
+		case float64:
+			f = n
+		case int64:
+			f = float64(n)
+		default:
+			return typeErr
+		}
+		if v.OverflowFloat(f) {
+			return typeErr
+		}
+		v.SetFloat(f)
+		return nil
+	case reflect.String:
+		s, ok := lv.(string)
+		if !ok {
+			return typeErr
+		}
+		v.SetString(s)
+		return nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if s, ok := lv.(string); ok {
+				v.SetBytes([]byte(s))
+				return nil
+			}
+		}
+		t, ok := lv.(*Table)
+		if !ok {
+			return typeErr
+		}
+		return sliceFromLua(t, v, depth)
+	case reflect.Array:
+		t, ok := lv.(*Table)
+		if !ok {
+			return typeErr
+		}
+		return sliceFromLua(t, v, depth)
+	case reflect.Map:
+		t, ok := lv.(*Table)
+		if !ok {
+			return typeErr
+		}
+		return mapFromLua(t, v, depth)
+	case reflect.Struct:
+		t, ok := lv.(*Table)
+		if !ok {
+			return typeErr
+		}
+		return structFromLua(t, v, info, depth)
+	default:
+		return typeErr
+	}
+}
+
+func luaInteger(lv any) (int64, bool) {
+	switch n := lv.(type) {
+	case int64:
+		return n, true
+	case float64:
+		if n == math.Trunc(n) && n >= math.MinInt64 && n < math.MaxInt64 {
+			return int64(n), true
+		}
+	}
+	return 0, false
+}
+
+// plainValue 把 *Table 转换成 []any 或者 map[any]any
+func plainValue(lv any) any {
+	t, ok := lv.(*Table)
+	if !ok {
+		return lv
+	}
+	if len(t.Hash) == 0 {
+		arr := make([]any, len(t.Array))
+		for i, v := range t.Array {
+			arr[i] = plainValue(v)
+		}
+		return arr
+	}
+	m := make(map[any]any, len(t.Array)+len(t.Hash))
+	for i, v := range t.Array {
+		m[int64(i+1)] = plainValue(v)
+	}
+	for k, v := range t.Hash {
+		m[k] = plainValue(v)
+	}
+	return m
+}
+
+// tableLen 数组部分加上 hash 部分连续的整数 key 的长度
+func tableLen(t *Table) int {
+	n := len(t.Array)
+	for {
+		if _, ok := t.Hash[int64(n+1)]; !ok {
+			return n
+		}
+		n++
+	}
+}
+
+func sliceFromLua(t *Table, v reflect.Value, depth int) error {
+	n := tableLen(t)
+	// hash 部分的稀疏整数 key, 长度不超过元素数量的 2 倍 (同 lua 数组部分的规则)
+	// 避免 {[50000000]=1} 这样的小包分配大量内存
+	limit := 2 * (len(t.Array) + len(t.Hash))
+	for k := range t.Hash {
+		if idx, ok := k.(int64); ok && idx > int64(n) {
+			if idx > int64(limit) {
+				return fmt.Errorf("sparse array index %d exceeds table size %d", idx, len(t.Array)+len(t.Hash))
+			}
+			n = int(idx)
+		}
+	}
+	if v.Kind() == reflect.Slice {
+		v.Set(reflect.MakeSlice(v.Type(), n, n))
+	} else {
+		v.SetZero()
+		if n > v.Len() {
+			n = v.Len()
+		}
+	}
+	for i := 0; i < n; i++ {
+		if err := fromLua(t.Get(int64(i+1)), v.Index(i), fieldInfo{}, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func mapFromLua(t *Table, v reflect.Value, depth int) error {
+	mt := v.Type()
+	if v.IsNil() {
+		v.Set(reflect.MakeMapWithSize(mt, len(t.Array)+len(t.Hash)))
+	}
+	set := func(lk, lv any) error {
+		key := reflect.New(mt.Key()).Elem()
+		if err := fromLua(lk, key, fieldInfo{}, depth+1); err != nil {
+			return err
+		}
+		val := reflect.New(mt.Elem()).Elem()
+		if err := fromLua(lv, val, fieldInfo{}, depth+1); err != nil {
+			return err
+		}
+		v.SetMapIndex(key, val)
+		return nil
+	}
+	for i, lv := range t.Array {
+		if err := set(int64(i+1), lv); err != nil {
+			return err
+		}
+	}
+	for lk, lv := range t.Hash {
+		if err := set(lk, lv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func structFromLua(t *Table, v reflect.Value, info fieldInfo, depth int) error {
+	// 没有 hash 部分的表按字段顺序解析
+	positional := info.asArray || (len(t.Hash) == 0 && len(t.Array) > 0)
+	for i, field := range cachedFields(v.Type()) {
+		var lv any
+		if positional {
+			lv = t.Get(int64(i + 1))
+		} else {
+			lv = t.Get(field.name)
+		}
+		if lv == nil {
+			continue
+		}
+		fv := v.FieldByIndex(field.index)
+		if err := fromLua(lv, fv, field, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package codec
+
+import (
+	"reflect"
+	"testing"
+)
+
+type (
+	testVector struct {
+		X, Y, Z float64
+	}
+
+	testBase struct {
+		Id int64 `lua:"id"`
+	}
+
+	testPlayer struct {
+		testBase
+		Name   string           `lua:"name"`
+		Level  int              `lua:"level,omitempty"`
+		Pos    testVector       `lua:"pos,array"`
+		Items  []string         `lua:"items"`
+		Slots  []*testVector    `lua:"slots,hash"`
+		Attrs  map[string]int32 `lua:"attrs"`
+		Flags  map[int]bool     `lua:"flags"`
+		Avatar []byte           `lua:"avatar"`
+		Extra  any              `lua:"extra"`
+		Skip   int              `lua:"-"`
+		hidden int
+	}
+)
+
+func TestMarshalStruct(t *testing.T) {
+	p := testPlayer{
+		testBase: testBase{Id: 10001},
+		Name:     "skynet",
+		Pos:      testVector{1, 2.5, -3},
+		Items:    []string{"a", "b"},
+		Slots:    []*testVector{nil, {X: 1}},
+		Attrs:    map[string]int32{"hp": 100},
+		Flags:    map[int]bool{1: true, 3: false},
+		Avatar:   []byte("png"),
+		Extra:    []any{int64(1), "x"},
+		Skip:     1,
+		hidden:   1,
+	}
+	data, err := Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := Unpack(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl := values[0].(*Table)
+	if tbl.Get("id") != int64(10001) || tbl.Get("name") != "skynet" {
+		t.Errorf("unexpected table %+v", tbl.Hash)
+	}
+	if tbl.Get("level") != nil || tbl.Get("Skip") != nil || tbl.Get("hidden") != nil {
+		t.Errorf("unexpected fields %+v", tbl.Hash)
+	}
+	pos := tbl.Get("pos").(*Table)
+	if !reflect.DeepEqual(pos.Array, []any{1.0, 2.5, -3.0}) {
+		t.Errorf("pos got %v", pos.Array)
+	}
+	slots := tbl.Get("slots").(*Table)
+	if len(slots.Array) != 0 || slots.Get(int64(2)) == nil {
+		t.Errorf("slots got %+v", slots)
+	}
+
+	var got testPlayer
+	if err := Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	p.Skip, p.hidden = 0, 0
+	if !reflect.DeepEqual(got, p) {
+		t.Errorf("unmarshal got %+v want %+v", got, p)
+	}
+}
+
+func TestUnmarshalLuaArray(t *testing.T) {
+	// {1, 2, 3} 既可以解析成 slice 也可以按字段顺序解析成结构体
+	data, _ := Pack([]any{1, 2, 3})
+	var arr []int
+	if err := Unmarshal(data, &arr); err != nil || !reflect.DeepEqual(arr, []int{1, 2, 3}) {
+		t.Errorf("unmarshal slice got %v %v", arr, err)
+	}
+	var vec testVector
+	if err := Unmarshal(data, &vec); err != nil || vec != (testVector{1, 2, 3}) {
+		t.Errorf("unmarshal struct got %v %v", vec, err)
+	}
+	// 稀疏的整数 key 保留空洞, 超过元素数量太多时返回错误, 不按 key 分配内存
+	data, _ = Pack(&Table{Array: []any{int64(1)}, Hash: map[any]any{int64(3): int64(3)}})
+	if err := Unmarshal(data, &arr); err != nil || !reflect.DeepEqual(arr, []int{1, 0, 3}) {
+		t.Errorf("unmarshal sparse slice got %v %v", arr, err)
+	}
+	data, _ = Pack(&Table{Hash: map[any]any{int64(50000000): int64(1)}})
+	var large []int64
+	if err := Unmarshal(data, &large); err == nil || len(large) != 0 {
+		t.Errorf("unmarshal large sparse index got len %d %v", len(large), err)
+	}
+	var n int8
+	data, _ = Pack(1000)
+	if err := Unmarshal(data, &n); err == nil {
+		t.Errorf("unmarshal overflow expect error")
+	}
+	var s string
+	if err := Unmarshal(data, &s); err == nil {
+		t.Errorf("unmarshal number to string expect error")
+	}
+}
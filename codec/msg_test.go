@@ -1,11 +1,226 @@
 package codec
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/cloudwego/netpoll"
 )
 
 func TestPackString(t *testing.T) {
 	msg := packString("cmd", "abcdefghijklmnopqrstuvwxyz1234567890")
 	fmt.Println(len(msg), string(msg))
 }
+
+func TestTraceReq(t *testing.T) {
+	large := strings.Repeat("x", int(PartSize)*2)
+	reqs := []*ReqPack{
+		{Addr: Addr{Name: "svc"}, Session: 1, Cmd: "small", Message: []byte("a"), Trace: "(node-1)tag"},
+		{Addr: Addr{Id: 9}, Session: 2, Cmd: "large", Message: []byte(large), Trace: "(node-2)tag"},
+		{Addr: Addr{Name: "svc"}, Session: 3, Cmd: "notrace", Message: []byte("b")},
+	}
+	buf := netpoll.NewLinkBuffer()
+	for _, req := range reqs {
+		if err := EncodeReq(buf, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf.Flush()
+
+	largeReq := make(map[uint32]*ReqPack)
+	var got []*ReqPack
+	// 等待中的 trace tag 不计入 MaxPartial
+	var trace string
+	limits := Limits{MaxPartial: 1}
+	for buf.Len() > 0 {
+		header, _ := buf.Next(2)
+		pkg, _ := buf.Slice(int(binary.BigEndian.Uint16(header)))
+		req, err := DecodeReqWithLimits(pkg, largeReq, &trace, limits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if req != nil {
+			got = append(got, req)
+		}
+	}
+	if len(got) != len(reqs) || len(largeReq) != 0 || trace != "" {
+		t.Fatalf("decode %d requests, %d pending, trace %q", len(got), len(largeReq), trace)
+	}
+	for i, req := range got {
+		// 解码时不复制第一个参数, Bytes 按需转换
+		if req.Message != nil || req.Text() != string(reqs[i].Message) || string(req.Bytes()) != string(reqs[i].Message) {
+			t.Errorf("request %d message not decoded lazily", i)
+		}
+		if req.Session != reqs[i].Session || req.Cmd != reqs[i].Cmd || req.Trace != reqs[i].Trace {
+			t.Errorf("request %d got session:%d cmd:%s trace:%q", i, req.Session, req.Cmd, req.Trace)
+		}
+	}
+
+	tooLong := &ReqPack{Addr: Addr{Id: 1}, Cmd: "cmd", Trace: strings.Repeat("t", MaxTraceSize+1)}
+	if err := EncodeReq(netpoll.NewLinkBuffer(), tooLong); err == nil {
+		t.Error("encode too long trace tag expect error")
+	}
+}
+
+func TestDecodeReqLimits(t *testing.T) {
+	large := strings.Repeat("x", int(PartSize)*2)
+	packets := make([][]netpoll.Reader, 4)
+	for session := uint32(1); session <= 3; session++ {
+		buf := netpoll.NewLinkBuffer()
+		req := &ReqPack{Addr: Addr{Name: "svc"}, Session: session, Cmd: "large", Message: []byte(large)}
+		if err := EncodeReq(buf, req); err != nil {
+			t.Fatal(err)
+		}
+		buf.Flush()
+		for buf.Len() > 0 {
+			header, _ := buf.Next(2)
+			pkg, _ := buf.Slice(int(binary.BigEndian.Uint16(header)))
+			packets[session] = append(packets[session], pkg)
+		}
+	}
+	// session 1 超过大小, session 2 和 3 同时接收, 3 超过数量
+	order := append([]netpoll.Reader{}, packets[1]...)
+	order = append(order, packets[2][0], packets[3][0])
+	order = append(order, packets[2][1:]...)
+	order = append(order, packets[3][1:]...)
+
+	limits := Limits{MaxSize: len(large) / 2, MaxPartial: 1}
+	largeReq := make(map[uint32]*ReqPack)
+	var rejected []uint32
+	var got []*ReqPack
+	for _, pkg := range order {
+		req, err := DecodeReqWithLimits(pkg, largeReq, new(string), limits)
+		switch {
+		case IsLimitError(err):
+			rejected = append(rejected, req.Session)
+			limits.MaxSize = 0
+		case err != nil:
+			t.Fatal(err)
+		case req != nil:
+			got = append(got, req)
+		}
+	}
+	if len(rejected) != 2 || rejected[0] != 1 || rejected[1] != 3 {
+		t.Errorf("rejected sessions got %v", rejected)
+	}
+	if len(got) != 1 || got[0].Session != 2 || len(largeReq) != 0 {
+		t.Errorf("decode %d requests, %d pending", len(got), len(largeReq))
+	}
+
+	// 超时的请求先回复错误, 下一次检查时移除
+	largeReq[4] = &ReqPack{Session: 4, started: time.Now().Add(-time.Minute)}
+	if expired := ExpireLargeReq(largeReq, time.Now()); len(expired) != 1 || expired[0].Session != 4 {
+		t.Fatalf("expired got %v", expired)
+	}
+	if ExpireLargeReq(largeReq, time.Now().Add(time.Second)); len(largeReq) != 0 {
+		t.Errorf("dropped request not removed")
+	}
+
+	// 同一个 session 重复的开始部分, 之前收到的部分被释放, 回复错误后忽略后续的部分
+	var parts [2][]netpoll.Reader
+	for i := range parts {
+		buf := netpoll.NewLinkBuffer()
+		if err := EncodeReq(buf, &ReqPack{Addr: Addr{Name: "svc"}, Session: 5, Cmd: "large", Message: []byte(large)}); err != nil {
+			t.Fatal(err)
+		}
+		buf.Flush()
+		for buf.Len() > 0 {
+			header, _ := buf.Next(2)
+			pkg, _ := buf.Slice(int(binary.BigEndian.Uint16(header)))
+			parts[i] = append(parts[i], pkg)
+		}
+	}
+	order = append([]netpoll.Reader{parts[0][0], parts[0][1], parts[1][0]}, parts[0][2:]...)
+	var dup []error
+	for _, pkg := range order {
+		req, err := DecodeReqWithLimits(pkg, largeReq, new(string), Limits{})
+		if err != nil {
+			if req == nil || req.Session != 5 {
+				t.Fatalf("duplicate begin got %v %v", req, err)
+			}
+			dup = append(dup, err)
+		} else if req != nil {
+			t.Errorf("duplicate session decoded request")
+		}
+	}
+	if len(dup) != 1 || !errors.Is(dup[0], ErrDuplicatePart) {
+		t.Errorf("duplicate begin errors got %v", dup)
+	}
+	if len(largeReq) != 0 {
+		t.Errorf("duplicate session not removed, %d pending", len(largeReq))
+	}
+}
+
+// benchmarkDecodeLarge 解码一个 size 字节字符串参数的 multi part 请求和回应
+func benchmarkDecodeLarge(b *testing.B, size int) {
+	payload := strings.Repeat("x", size)
+	req := netpoll.NewLinkBuffer()
+	if err := EncodeReq(req, &ReqPack{Addr: Addr{Name: "svc"}, Session: 1, Cmd: "set", Args: []any{payload}}); err != nil {
+		b.Fatal(err)
+	}
+	req.Flush()
+	reqData, _ := req.ReadBinary(req.Len())
+	resp := netpoll.NewLinkBuffer()
+	if err := EncodeResp(resp, &RespPack{Session: 1, Ok: true, Results: []any{payload}}); err != nil {
+		b.Fatal(err)
+	}
+	respData, _ := resp.ReadBinary(resp.Len())
+
+	decode := func(data []byte, fn func(pkg netpoll.Reader) (any, error)) {
+		buf := netpoll.NewLinkBuffer()
+		buf.WriteDirect(data, 0)
+		buf.Flush()
+		var got any
+		for buf.Len() > 0 {
+			header, _ := buf.Next(2)
+			pkg, _ := buf.Slice(int(binary.BigEndian.Uint16(header)))
+			v, err := fn(pkg)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if v != nil {
+				got = v
+			}
+		}
+		if got == nil {
+			b.Fatal("message not decoded")
+		}
+		buf.Release()
+	}
+
+	b.Run("req", func(b *testing.B) {
+		b.SetBytes(int64(size))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			largeReq := make(map[uint32]*ReqPack)
+			decode(reqData, func(pkg netpoll.Reader) (any, error) {
+				req, err := DecodeReq(pkg, largeReq)
+				if req == nil {
+					return nil, err
+				}
+				return req, err
+			})
+		}
+	})
+	b.Run("resp", func(b *testing.B) {
+		b.SetBytes(int64(size))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			largeResp := make(map[uint32]*RespPack)
+			decode(respData, func(pkg netpoll.Reader) (any, error) {
+				resp, err := DecodeResp(pkg, largeResp)
+				if resp == nil {
+					return nil, err
+				}
+				return resp, err
+			})
+		}
+	})
+}
+
+func BenchmarkDecodeLarge1MB(b *testing.B) { benchmarkDecodeLarge(b, 1<<20) }
+func BenchmarkDecodeLarge8MB(b *testing.B) { benchmarkDecodeLarge(b, 8<<20) }
@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/cloudwego/netpoll"
 )
@@ -17,10 +18,152 @@ type (
 		Addr    Addr   // 4-7
 		Session uint32 // 8-11
 		Cmd     string
-		Message []byte
+		Message []byte // 发送时为第一个参数, 解码时不设置, 使用 Bytes/Text 读取
+		Args    []any  // cmd 之后的所有参数, 非 nil 时按 skynet.pack(cmd, args...) 打包
+		Trace   string // skynet.trace 的 tag, 非空时在请求之前发送 trace 包 (type 4)
+		Size    int    // 打包后的参数大小, EncodeReq/DecodeReq 时设置
+
+		packed  []byte    // Pack 的结果, EncodeReq 时不再重复打包
+		parts   *chain    // multi part 请求已经收到的部分
+		started time.Time // multi part 请求开始接收的时间
+		push    bool      // multi part 请求是否为 push
+		dropped bool      // 超过限制或者超时的 multi part 请求, 后续的部分直接忽略
 	}
 )
 
+const (
+	// MaxTraceSize 同 skynet cluster.packtrace 的限制
+	MaxTraceSize = 0x8000
+
+	// DecodeReq 在 largeReq 的 session 0 中保存还未使用的 trace tag
+	traceSession = 0
+)
+
+// takeTrace 取出等待中的 trace tag, 由 trace 包之后的第一个请求使用
+func takeTrace(trace *string) string {
+	tag := *trace
+	*trace = ""
+	return tag
+}
+
+// 解析 trace 包, tag 附加到下一个请求
+func unpackTrace(pkg netpoll.Reader, trace *string) (*ReqPack, error) {
+	tag, err := pkg.ReadString(pkg.Len())
+	if err != nil {
+		return nil, err
+	}
+	*trace = tag
+	return nil, nil
+}
+
+// setValues 解析 skynet.pack(cmd, ...) 得到的参数列表
+func (req *ReqPack) setValues(values []any) error {
+	if len(values) == 0 {
+		return errors.New("invalid request without cmd")
+	}
+	cmd, ok := values[0].(string)
+	if !ok {
+		return fmt.Errorf("invalid request cmd type %T", values[0])
+	}
+	req.Cmd = cmd
+	req.Args = values[1:]
+	req.Message = nil
+	return nil
+}
+
+// Text 第一个参数为 string 时直接返回, 不复制; 否则返回 Message
+func (req *ReqPack) Text() string {
+	if req.Message == nil && len(req.Args) > 0 {
+		s, _ := req.Args[0].(string)
+		return s
+	}
+	return string(req.Message)
+}
+
+// Bytes 同 Text, 第一次调用时复制第一个 string 参数并保存到 Message
+func (req *ReqPack) Bytes() []byte {
+	if req.Message == nil && len(req.Args) > 0 {
+		if s, ok := req.Args[0].(string); ok {
+			req.Message = []byte(s)
+		}
+	}
+	return req.Message
+}
+
+// Multipart 请求是否按 multi part 发送
+func (req *ReqPack) Multipart() bool {
+	return req.Size >= int(PartSize)
+}
+
+// Pack 提前打包参数并设置 Size, 用于发送前根据大小选择链接, 之后不能再修改参数
+func (req *ReqPack) Pack() error {
+	data, err := req.pack()
+	if err != nil {
+		return err
+	}
+	req.packed = data
+	req.Size = len(data)
+	return nil
+}
+
+// pack 打包 cmd 和参数, Args 为 nil 时兼容只有一个字符串参数的 Message
+func (req *ReqPack) pack() ([]byte, error) {
+	if req.packed != nil {
+		return req.packed, nil
+	}
+	if req.Args == nil {
+		return packString(req.Cmd, string(req.Message)), nil
+	}
+	values := make([]any, 0, len(req.Args)+1)
+	values = append(values, req.Cmd)
+	values = append(values, req.Args...)
+	return Pack(values...)
+}
+
+// drop 丢弃已经收到的部分, 保留 session 直到收到最后一部分或者下一次超时检查
+func (req *ReqPack) drop(now time.Time) {
+	req.dropped = true
+	req.parts.release()
+	req.parts = nil
+	req.started = now
+}
+
+// reply 用于回复错误的请求, push 的 session 为 0
+func (req *ReqPack) reply() *ReqPack {
+	r := &ReqPack{Addr: req.Addr}
+	if !req.push {
+		r.Session = req.Session
+	}
+	return r
+}
+
+// beginLargeReq 登记一个 multi part 请求, 超过 limits 时返回需要回复的错误, 后续的部分直接忽略
+// 丢弃的请求最多保留 2*MaxPartial 个, 超过后收到的部分按未知 session 返回错误
+func beginLargeReq(largeReq map[uint32]*ReqPack, trace *string, req *ReqPack, msgsize uint32, limits Limits) (*ReqPack, error) {
+	req.Trace = takeTrace(trace)
+	req.started = time.Now()
+	req.Size = int(msgsize)
+	if prev, ok := largeReq[req.Session]; ok {
+		// 同一个 session 重复的开始部分: 释放已经收到的部分, 回复错误, 后续的部分直接忽略
+		if prev.dropped {
+			prev.started = req.started
+			return nil, nil
+		}
+		prev.drop(req.started)
+		return prev.reply(), fmt.Errorf("%w (session=%d)", ErrDuplicatePart, req.Session)
+	}
+	if err := limits.check(msgsize, len(largeReq)); err != nil {
+		if limits.MaxPartial == 0 || len(largeReq) < limits.MaxPartial*2 {
+			req.drop(req.started)
+			largeReq[req.Session] = req
+		}
+		return req.reply(), err
+	}
+	req.parts = newChain()
+	largeReq[req.Session] = req
+	return nil, nil
+}
+
 // NOTE: kitex 不支持整数ID服务地址调用
 func unpackReqNumber(pkg netpoll.Reader) (*ReqPack, error) {
 	len := pkg.Len()
@@ -47,19 +190,16 @@ func unpackReqNumber(pkg netpoll.Reader) (*ReqPack, error) {
 		Addr:    Addr{Id: sid},
 		Session: session,
 	}
-	// cmd
-	bcmd, err := unpackString(pkg)
+	// cmd, args...
+	req.Size = pkg.Len()
+	values, err := UnpackReader(pkg)
 	if err != nil {
 		return req, err
 	}
-	req.Cmd = string(bcmd)
-
-	// args
-	data, err := unpackString(pkg)
+	err = req.setValues(values)
 	if err != nil {
 		return req, err
 	}
-	req.Message = data
 	//msg := string(data)
 	return req, nil
 }
@@ -92,31 +232,28 @@ func unpackReqStr(pkg netpoll.Reader) (*ReqPack, error) {
 	if err != nil {
 		return nil, err
 	}
-	session := binary.BigEndian.Uint32(bSession)
+	session := binary.LittleEndian.Uint32(bSession)
 	req := &ReqPack{
 		Addr:    Addr{Name: sname},
 		Session: session,
 	}
 
-	// cmd
-	bcmd, err := unpackString(pkg)
+	// cmd, args...
+	req.Size = pkg.Len()
+	values, err := UnpackReader(pkg)
 	if err != nil {
 		return req, err
 	}
-	req.Cmd = string(bcmd)
-
-	// args
-	data, err := unpackString(pkg)
+	err = req.setValues(values)
 	if err != nil {
 		return req, err
 	}
-	req.Message = data
 
 	return req, nil
 }
 
 // 解析整数地址的一个大包 头部
-func unpackLargeReqNumber(pkg netpoll.Reader, largeReq map[uint32]*ReqPack, push bool) (*ReqPack, error) {
+func unpackLargeReqNumber(pkg netpoll.Reader, largeReq map[uint32]*ReqPack, trace *string, push bool, limits Limits) (*ReqPack, error) {
 	len := pkg.Len()
 	if len != 12 {
 		errmsg := fmt.Sprintf("invalid cluster message size %d (multi req must be 13)", len)
@@ -131,19 +268,16 @@ func unpackLargeReqNumber(pkg netpoll.Reader, largeReq map[uint32]*ReqPack, push
 	req := &ReqPack{
 		Addr:    Addr{Id: sid},
 		Session: session,
+		push:    push,
 	}
 	// msgsize(4)
 	bSize, _ := pkg.ReadBinary(4)
 	msgsize := binary.LittleEndian.Uint32(bSize)
-
-	req.Message = make([]byte, 0, msgsize)
-	//req.Bytes = []byte{}
-	largeReq[session] = req
-	return nil, nil
+	return beginLargeReq(largeReq, trace, req, msgsize, limits)
 }
 
 // 解析一个字符串地址的大包头部
-func unpackLargeReqStr(pkg netpoll.Reader, largeReq map[uint32]*ReqPack, push bool) (*ReqPack, error) {
+func unpackLargeReqStr(pkg netpoll.Reader, largeReq map[uint32]*ReqPack, trace *string, push bool, limits Limits) (*ReqPack, error) {
 	len := pkg.Len()
 	if len < 2 {
 		errmsg := fmt.Sprintf("Invalid cluster message (size=%d)", len)
@@ -167,13 +301,12 @@ func unpackLargeReqStr(pkg netpoll.Reader, largeReq map[uint32]*ReqPack, push bo
 	req := &ReqPack{
 		Addr:    Addr{Name: sname},
 		Session: session,
+		push:    push,
 	}
 	// msgsize(4)
 	bLen, _ = pkg.ReadBinary(4)
 	msgsize := binary.LittleEndian.Uint32(bLen)
-	req.Message = make([]byte, 0, msgsize)
-	largeReq[session] = req
-	return nil, nil
+	return beginLargeReq(largeReq, trace, req, msgsize, limits)
 }
 
 // 解析大包的一部分
@@ -192,21 +325,64 @@ func unpackLargeReqPart(pkg netpoll.Reader, largeReq map[uint32]*ReqPack, lastPa
 		errmsg := fmt.Sprintf("invalid large req part session=%d", session)
 		return nil, errors.New(errmsg)
 	}
-	var p, _ = pkg.Next(sz - 4)
-	req.Message = append(req.Message, p...)
-	if lastPart {
-		delete(largeReq, session)
-		args, err := unpackStringsFromBytes(req.Message)
-		if err != nil {
-			return req, err
+	if req.dropped {
+		if lastPart {
+			delete(largeReq, session)
+		}
+		return nil, nil
+	}
+	if req.parts.size+sz-4 > req.Size {
+		// 超过开始时声明的大小
+		err := fmt.Errorf("%w (size>%d)", ErrMessageTooLarge, req.Size)
+		if lastPart {
+			delete(largeReq, session)
+		} else {
+			req.drop(time.Now())
 		}
-		req.Cmd = args[0]
-		req.Message = []byte(args[1])
+		return req.reply(), err
+	}
+	if err := req.parts.append(pkg, sz-4); err != nil {
+		delete(largeReq, session)
+		req.parts.release()
+		return req.reply(), err
+	}
+	if !lastPart {
+		return nil, nil
+	}
+
+	delete(largeReq, session)
+	req.Size = req.parts.size
+	values, err := req.parts.unpack()
+	req.parts = nil
+	if err != nil {
+		return req, err
+	}
+	err = req.setValues(values)
+	if err != nil {
+		return req, err
 	}
 	return req, nil
 }
 
+// DecodeReq 解析一个请求包, largeReq 保存链接上未完成的 multi part 请求和等待中的 trace tag
+// multi part 请求未收完或者 trace 包返回 nil, nil
 func DecodeReq(pkg netpoll.Reader, largeReq map[uint32]*ReqPack) (*ReqPack, error) {
+	var trace string
+	// 没有开始时间的是 trace tag, 不是 multi part 请求
+	if pending, ok := largeReq[traceSession]; ok && pending.started.IsZero() {
+		trace = pending.Trace
+		delete(largeReq, traceSession)
+	}
+	req, err := DecodeReqWithLimits(pkg, largeReq, &trace, Limits{})
+	if _, ok := largeReq[traceSession]; trace != "" && !ok {
+		largeReq[traceSession] = &ReqPack{Trace: trace}
+	}
+	return req, err
+}
+
+// DecodeReqWithLimits 同 DecodeReq, trace 保存链接上等待中的 trace tag, 不计入 largeReq
+// multi part 请求超过 limits 时返回只有地址和 session 的请求和错误, 用于回复对方, 这个请求后续的部分直接忽略
+func DecodeReqWithLimits(pkg netpoll.Reader, largeReq map[uint32]*ReqPack, trace *string, limits Limits) (*ReqPack, error) {
 	defer pkg.Release()
 
 	len := pkg.Len()
@@ -221,27 +397,37 @@ func DecodeReq(pkg netpoll.Reader, largeReq map[uint32]*ReqPack) (*ReqPack, erro
 
 	switch msgType {
 	case 0:
-		return unpackReqNumber(pkg)
+		trace := takeTrace(trace)
+		req, err := unpackReqNumber(pkg)
+		if req != nil {
+			req.Trace = trace
+		}
+		return req, err
 	case 1:
 		// request
-		return unpackLargeReqNumber(pkg, largeReq, false)
+		return unpackLargeReqNumber(pkg, largeReq, trace, false, limits)
 	case '\x41':
 		// push
-		return unpackLargeReqNumber(pkg, largeReq, true)
+		return unpackLargeReqNumber(pkg, largeReq, trace, true, limits)
 	case 2:
 		return unpackLargeReqPart(pkg, largeReq, false)
 	case 3:
 		return unpackLargeReqPart(pkg, largeReq, true)
 	case 4:
-		return nil, errors.New("nonsupport trace msg")
+		return unpackTrace(pkg, trace)
 	case '\x80':
-		return unpackReqStr(pkg)
+		trace := takeTrace(trace)
+		req, err := unpackReqStr(pkg)
+		if req != nil {
+			req.Trace = trace
+		}
+		return req, err
 	case '\x81':
 		// request
-		return unpackLargeReqStr(pkg, largeReq, false)
+		return unpackLargeReqStr(pkg, largeReq, trace, false, limits)
 	case '\xc1':
 		// push
-		return unpackLargeReqStr(pkg, largeReq, true)
+		return unpackLargeReqStr(pkg, largeReq, trace, true, limits)
 	default:
 		errmsg := fmt.Sprintf("invalid req package (type=%d)", msgType)
 		return nil, errors.New(errmsg)
@@ -249,8 +435,12 @@ func DecodeReq(pkg netpoll.Reader, largeReq map[uint32]*ReqPack) (*ReqPack, erro
 }
 
 func EncodeReq(writer netpoll.Writer, msg *ReqPack) error {
-	bytes := packString(msg.Cmd, string(msg.Message))
+	bytes, err := msg.pack()
+	if err != nil {
+		return err
+	}
 	sz := uint32(len(bytes))
+	msg.Size = len(bytes)
 
 	var isPush = false
 	var session = msg.Session
@@ -262,6 +452,18 @@ func EncodeReq(writer netpoll.Writer, msg *ReqPack) error {
 		return errors.New("invalid request addr")
 	}
 
+	if msg.Trace != "" {
+		tracesz := len(msg.Trace)
+		if tracesz > MaxTraceSize {
+			return fmt.Errorf("trace tag is too long : %d", tracesz)
+		}
+		// type(1)+tag, 和请求写在同一个 buffer 中保证在请求之前发送
+		header, _ := writer.Malloc(2)
+		binary.BigEndian.PutUint16(header, uint16(tracesz+1))
+		writer.WriteByte(4)
+		writer.WriteString(msg.Trace)
+	}
+
 	// first WORD is size of the package with big-endian
 	if sz < PartSize {
 		if msg.Addr.Id > 0 {
@@ -286,7 +488,7 @@ func EncodeReq(writer netpoll.Writer, msg *ReqPack) error {
 		if msg.Addr.Id > 0 {
 			header, _ := writer.Malloc(2)
 			// multi part header byte(1)+addr(4)+session(4)+msgsize(4)=13
-			binary.BigEndian.PutUint16(header, uint16(sz+13))
+			binary.BigEndian.PutUint16(header, 13)
 			if isPush {
 				writer.WriteByte(0x41)
 			} else {
@@ -331,7 +533,7 @@ func EncodeReq(writer netpoll.Writer, msg *ReqPack) error {
 			session, _ := writer.Malloc(4)
 			binary.LittleEndian.PutUint32(session, msg.Session)
 			writer.WriteBinary(bytes[index : index+s])
-			index = s
+			index += s
 			sz = sz - s
 		}
 	}
@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/cloudwego/netpoll"
 )
@@ -22,18 +23,67 @@ type (
 	RespPack struct {
 		Ok      bool   // msg pack/unpack
 		Session uint32 // DWORD
-		Message []byte // 0: errmsg  1: msg  2: DWORD size   3/4: msg
+		Message []byte // 0: errmsg  1: msg, 解码成功的回应不设置, 使用 Bytes/Text 读取
+		Results []any  // 所有返回值, 非 nil 时按 skynet.pack(results...) 打包
+		Size    int    // 打包后的返回值大小, EncodeResp/DecodeResp 时设置
+
+		parts   *chain    // multi part 回应已经收到的部分
+		started time.Time // multi part 回应开始接收的时间
 	}
 )
 
+// setValues 解析 skynet.pack(...) 得到的返回值, 第一个返回值由 Bytes/Text 按需转换
+func (resp *RespPack) setValues(values []any) {
+	resp.Results = values
+	resp.Message = nil
+}
+
+// Text 第一个返回值为 string 时直接返回, 不复制; 否则返回 Message (错误信息)
+func (resp *RespPack) Text() string {
+	if resp.Message == nil && len(resp.Results) > 0 {
+		s, _ := resp.Results[0].(string)
+		return s
+	}
+	return string(resp.Message)
+}
+
+// Bytes 同 Text, 第一次调用时复制第一个 string 返回值并保存到 Message
+func (resp *RespPack) Bytes() []byte {
+	if resp.Message == nil && len(resp.Results) > 0 {
+		if s, ok := resp.Results[0].(string); ok {
+			resp.Message = []byte(s)
+		}
+	}
+	return resp.Message
+}
+
+// Multipart 返回值是否按 multi part 发送
+func (resp *RespPack) Multipart() bool {
+	return resp.Ok && resp.Size > int(PartSize)
+}
+
+// pack 打包返回值, 错误信息和 skynet 一样直接发送原始字符串
+func (resp *RespPack) pack() ([]byte, error) {
+	if !resp.Ok {
+		return resp.Message, nil
+	}
+	if resp.Results != nil {
+		return Pack(resp.Results...)
+	}
+	return packString(string(resp.Message)), nil
+}
+
 const (
 	PartSize uint32 = 0x8000
 )
 
 func EncodeResp(writer netpoll.Writer, msg *RespPack) error {
-	var err error
-	data := packString(string(msg.Message))
+	data, err := msg.pack()
+	if err != nil {
+		return err
+	}
 	sz := uint32(len(data))
+	msg.Size = len(data)
 	bType := RespTypeOk
 	if msg.Ok {
 		if sz > PartSize {
@@ -65,7 +115,7 @@ func EncodeResp(writer netpoll.Writer, msg *RespPack) error {
 				binary.LittleEndian.PutUint32(session, msg.Session)
 				writer.WriteByte(byte(bType))
 				writer.WriteBinary(data[index : index+s])
-				index = s
+				index += s
 				sz = sz - s
 			}
 			err = writer.Flush()
@@ -95,6 +145,12 @@ func EncodeResp(writer netpoll.Writer, msg *RespPack) error {
 }
 
 func DecodeResp(pkg netpoll.Reader, largeResp map[uint32]*RespPack) (*RespPack, error) {
+	return DecodeRespWithLimits(pkg, largeResp, Limits{})
+}
+
+// DecodeRespWithLimits 同 DecodeResp, multi part 回应超过 limits 时返回只有 session 的回应和错误
+// 不再保存这个回应, 后续的部分由调用方忽略
+func DecodeRespWithLimits(pkg netpoll.Reader, largeResp map[uint32]*RespPack, limits Limits) (*RespPack, error) {
 	defer pkg.Release()
 	headersz := 5
 	sz := pkg.Len()
@@ -114,7 +170,7 @@ func DecodeResp(pkg netpoll.Reader, largeResp map[uint32]*RespPack) (*RespPack,
 
 	switch code {
 	case 0: // error
-		msg, err := unpackString(pkg)
+		msg, err := pkg.ReadBinary(sz - headersz)
 		if err != nil {
 			return nil, err
 		}
@@ -125,59 +181,89 @@ func DecodeResp(pkg netpoll.Reader, largeResp map[uint32]*RespPack) (*RespPack,
 		}
 		return resp, nil
 	case 1: // ok
-		msg, err := unpackString(pkg)
+		size := pkg.Len()
+		values, err := UnpackReader(pkg)
 		if err != nil {
 			return nil, err
 		}
 		resp := &RespPack{
 			Session: session,
 			Ok:      true,
-			Message: msg,
+			Size:    size,
 		}
+		resp.setValues(values)
 		return resp, nil
 	case 4: // multi end
-		msg, err := pkg.ReadBinary(sz - headersz)
-		if err != nil {
-			return nil, err
-		}
-		if resp, ok := largeResp[session]; ok {
-			data := append(resp.Message, msg...)
-			args, err := unpackStringsFromBytes(data)
-			if err != nil {
-				return nil, err
-			}
-			resp.Message = []byte(args[0])
-			return resp, nil
-		} else {
-			return nil, fmt.Errorf("invalid large response end part session=(%d)", session)
-		}
+		return unpackLargeRespPart(pkg, largeResp, session, true)
 	case 2: // multi begin
 		if sz != 9 {
 			return nil, fmt.Errorf("multi begin invalid header sz(%d)", sz)
 		}
-		msg, err := pkg.ReadBinary(sz - headersz)
+		bSize, err := pkg.ReadBinary(sz - headersz)
 		if err != nil {
 			return nil, err
 		}
+		msgsize := binary.LittleEndian.Uint32(bSize)
+		if err := limits.check(msgsize, len(largeResp)); err != nil {
+			return &RespPack{Session: session}, err
+		}
 		resp := &RespPack{
 			Session: session,
 			Ok:      true,
-			Message: msg,
+			Size:    int(msgsize),
+			parts:   newChain(),
+			started: time.Now(),
+		}
+		if prev, ok := largeResp[session]; ok {
+			// 重复的开始部分, 释放之前收到的部分
+			prev.Release()
 		}
 		largeResp[session] = resp
 		return nil, nil
 	case 3: // multi part
-		msg, err := pkg.ReadBinary(sz - headersz)
-		if err != nil {
-			return nil, err
-		}
-		if resp, ok := largeResp[session]; ok {
-			resp.Message = append(resp.Message, msg...)
-			return nil, nil
-		} else {
-			return nil, fmt.Errorf("invalid large response part session=(%d)", session)
-		}
+		return unpackLargeRespPart(pkg, largeResp, session, false)
 	default:
 		return nil, nil
 	}
 }
+
+// unpackLargeRespPart 引用 multi part 回应的一部分, 收到最后一部分时解码
+func unpackLargeRespPart(pkg netpoll.Reader, largeResp map[uint32]*RespPack, session uint32, lastPart bool) (*RespPack, error) {
+	resp, ok := largeResp[session]
+	if !ok {
+		if lastPart {
+			return nil, fmt.Errorf("invalid large response end part session=(%d)", session)
+		}
+		return nil, fmt.Errorf("invalid large response part session=(%d)", session)
+	}
+	n := pkg.Len()
+	if resp.parts.size+n > resp.Size {
+		delete(largeResp, session)
+		resp.Release()
+		return &RespPack{Session: session}, fmt.Errorf("%w (size>%d)", ErrMessageTooLarge, resp.Size)
+	}
+	if err := resp.parts.append(pkg, n); err != nil {
+		delete(largeResp, session)
+		resp.Release()
+		return nil, err
+	}
+	if !lastPart {
+		return nil, nil
+	}
+
+	delete(largeResp, session)
+	resp.Size = resp.parts.size
+	values, err := resp.parts.unpack()
+	resp.parts = nil
+	if err != nil {
+		return nil, err
+	}
+	resp.setValues(values)
+	return resp, nil
+}
+
+// Release 释放未收完的 multi part 回应引用的网络包, 从 DecodeResp 的 largeResp 中移除时调用
+func (resp *RespPack) Release() {
+	resp.parts.release()
+	resp.parts = nil
+}
@@ -1,145 +1,511 @@
 package codec
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"math"
 
 	"github.com/cloudwego/netpoll"
 )
 
-func unpackString(pkg netpoll.Reader) ([]byte, error) {
-	header, err := pkg.ReadByte()
-	if err != nil {
-		return nil, err
+// 与 skynet lua-seri.c 保持一致
+const (
+	typeNil         = 0
+	typeBoolean     = 1 // hibits 0 false 1 true
+	typeNumber      = 2 // hibits 0:0, 1:byte, 2:word, 4:dword, 6:qword, 8:double
+	typeUserData    = 3
+	typeShortString = 4 // hibits 0~31 : len
+	typeLongString  = 5
+	typeTable       = 6
+
+	typeNumberZero  = 0
+	typeNumberByte  = 1
+	typeNumberWord  = 2
+	typeNumberDword = 4
+	typeNumberQword = 6
+	typeNumberReal  = 8
+
+	maxCookie = 32
+
+	// MaxDepth lua table 最大嵌套层数
+	MaxDepth = 32
+)
+
+type (
+	// Table lua table
+	// Array 为数组部分 t[1]..t[n], Hash 为其余的 key-value
+	// 解码时整数 key 为 int64, 浮点数为 float64, 子表为 *Table
+	Table struct {
+		Array []any
+		Hash  map[any]any
 	}
 
-	vType := header & 0x7
-	vLen := int(header >> 3)
+	// LightUserData lua lightuserdata, 只是一个指针值, 跨进程没有意义
+	LightUserData uint64
 
-	switch vType {
-	/*
-		case 0:
-			// lua nil
-		case 1:
-			// boolean
-		case 2:
-			// lua number
-		case 3:
-			// lua userdate
-		case 6:
-			// lua table
-	*/
-	case 4:
-		// 短字符串
-		return pkg.ReadBinary(vLen)
-	case 5:
-		// 长字符串
-		if vLen == 2 || vLen == 4 {
-			bsize, err := pkg.ReadBinary(vLen)
-			if err != nil {
-				return nil, err
-			}
-			var size int
-			if vLen == 2 {
-				plen := binary.LittleEndian.Uint16(bsize)
-				size = int(plen)
-			} else {
-				plen := binary.LittleEndian.Uint32(bsize)
-				size = int(plen)
-			}
-			return pkg.ReadBinary(size)
-		} else {
-			errmsg := fmt.Sprintf("nonsupport data invalid stream (type=%d,cookie=%d)", vType, vLen)
-			return nil, errors.New(errmsg)
+	// source 解码的数据来源, netpoll.Reader 也满足该接口
+	source interface {
+		ReadByte() (byte, error)
+		Next(n int) ([]byte, error)
+	}
+
+	stringSource interface {
+		ReadString(n int) (string, error)
+	}
+
+	bytesSource struct {
+		data []byte
+	}
+
+	decoder struct {
+		src   source
+		depth int
+	}
+)
+
+var (
+	ErrTooDepth = errors.New("serialize can't pack too depth table")
+)
+
+func NewTable() *Table {
+	return &Table{}
+}
+
+// Len 数组部分长度, 对应 lua 的 #t (不含 hash 部分)
+func (t *Table) Len() int {
+	return len(t.Array)
+}
+
+// Get 读取 t[key], 整数 key 优先查找数组部分
+func (t *Table) Get(key any) any {
+	if idx, ok := toInteger(key); ok && idx >= 1 && idx <= int64(len(t.Array)) {
+		return t.Array[idx-1]
+	}
+	if t.Hash == nil {
+		return nil
+	}
+	if idx, ok := toInteger(key); ok {
+		key = idx
+	}
+	return t.Hash[key]
+}
+
+// Set 设置 t[key] = value, key 为 len+1 时追加到数组部分
+func (t *Table) Set(key any, value any) {
+	if idx, ok := toInteger(key); ok {
+		if idx >= 1 && idx <= int64(len(t.Array)) {
+			t.Array[idx-1] = value
+			return
 		}
-	default:
-		errmsg := fmt.Sprintf("nonsupport data unpack (type=%d)", vType)
-		return nil, errors.New(errmsg)
+		if idx == int64(len(t.Array))+1 && value != nil {
+			t.Array = append(t.Array, value)
+			return
+		}
+		key = idx
+	}
+	if t.Hash == nil {
+		t.Hash = make(map[any]any)
+	}
+	if value == nil {
+		delete(t.Hash, key)
+		return
 	}
+	t.Hash[key] = value
+}
+
+func toInteger(key any) (int64, bool) {
+	switch k := key.(type) {
+	case int:
+		return int64(k), true
+	case int32:
+		return int64(k), true
+	case int64:
+		return k, true
+	case uint32:
+		return int64(k), true
+	}
+	return 0, false
 }
 
 func combineType(t, v uint8) uint8 {
 	return t | v<<3
 }
 
-func packString(strs ...string) []byte {
-	buffer := bytes.Buffer{}
+// Pack 按 skynet.pack 的格式序列化多个值
+// 支持 nil/bool/整数/浮点数/string/[]byte/LightUserData/*Table/[]any/map[string]any/map[any]any
+// 其他类型 (struct/slice/map/指针) 按 Marshal 的规则转换
+func Pack(values ...any) ([]byte, error) {
+	var data []byte
+	var err error
+	for _, v := range values {
+		data, err = appendValue(data, v, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
 
-	for _, s := range strs {
-		len := len(s)
-		if len < 32 {
-			n := combineType(4, uint8(len))
-			buffer.WriteByte(n)
-			if len > 0 {
-				buffer.WriteString(s)
-			}
-		} else {
-			if len < 0x10000 {
-				n := combineType(5, 2)
-				buffer.WriteByte(n)
-				buffer.Grow(2)
-				binary.LittleEndian.AppendUint16(buffer.Bytes(), uint16(len))
-			} else {
-				n := combineType(5, 4)
-				buffer.WriteByte(n)
-				buffer.Grow(4)
-				binary.LittleEndian.AppendUint32(buffer.Bytes(), uint32(len))
-			}
-			buffer.WriteString(s)
+// Unpack 按 skynet.unpack 的格式反序列化出所有值
+func Unpack(data []byte) ([]any, error) {
+	return unpackSource(&bytesSource{data: data})
+}
+
+// UnpackReader 从 netpoll.Reader 中反序列化出剩余的所有值
+func UnpackReader(pkg netpoll.Reader) ([]any, error) {
+	return unpackSource(pkg)
+}
+
+func unpackSource(src source) ([]any, error) {
+	values := []any{}
+	d := &decoder{src: src}
+	for {
+		header, err := src.ReadByte()
+		if err != nil {
+			// 数据读完
+			return values, nil
 		}
+		v, err := d.value(header&0x7, header>>3)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
 	}
-	return buffer.Bytes()
 }
 
-func unpackStringsFromBytes(data []byte) ([]string, error) {
-	strs := []string{}
+func appendInteger(data []byte, v int64) []byte {
+	if v == 0 {
+		return append(data, combineType(typeNumber, typeNumberZero))
+	}
+	if v != int64(int32(v)) {
+		data = append(data, combineType(typeNumber, typeNumberQword))
+		return binary.LittleEndian.AppendUint64(data, uint64(v))
+	}
+	if v < 0 {
+		data = append(data, combineType(typeNumber, typeNumberDword))
+		return binary.LittleEndian.AppendUint32(data, uint32(int32(v)))
+	}
+	if v < 0x100 {
+		return append(data, combineType(typeNumber, typeNumberByte), byte(v))
+	}
+	if v < 0x10000 {
+		data = append(data, combineType(typeNumber, typeNumberWord))
+		return binary.LittleEndian.AppendUint16(data, uint16(v))
+	}
+	data = append(data, combineType(typeNumber, typeNumberDword))
+	return binary.LittleEndian.AppendUint32(data, uint32(v))
+}
+
+// appendUnsigned lua-seri 只能保存 int64, 超过 math.MaxInt64 的无符号整数返回错误
+func appendUnsigned(data []byte, v uint64) ([]byte, error) {
+	if v > math.MaxInt64 {
+		return nil, fmt.Errorf("integer %d overflow lua integer", v)
+	}
+	return appendInteger(data, int64(v)), nil
+}
+
+func appendReal(data []byte, v float64) []byte {
+	data = append(data, combineType(typeNumber, typeNumberReal))
+	return binary.LittleEndian.AppendUint64(data, math.Float64bits(v))
+}
+
+func appendString(data []byte, s string) []byte {
+	sz := len(s)
+	if sz < maxCookie {
+		data = append(data, combineType(typeShortString, uint8(sz)))
+	} else if sz < 0x10000 {
+		data = append(data, combineType(typeLongString, 2))
+		data = binary.LittleEndian.AppendUint16(data, uint16(sz))
+	} else {
+		data = append(data, combineType(typeLongString, 4))
+		data = binary.LittleEndian.AppendUint32(data, uint32(sz))
+	}
+	return append(data, s...)
+}
+
+func appendArrayHeader(data []byte, n int) []byte {
+	if n >= maxCookie-1 {
+		data = append(data, combineType(typeTable, maxCookie-1))
+		return appendInteger(data, int64(n))
+	}
+	return append(data, combineType(typeTable, uint8(n)))
+}
+
+func appendTable(data []byte, t *Table, depth int) ([]byte, error) {
+	var err error
+	data = appendArrayHeader(data, len(t.Array))
+	for _, v := range t.Array {
+		if data, err = appendValue(data, v, depth+1); err != nil {
+			return nil, err
+		}
+	}
+	for k, v := range t.Hash {
+		if k == nil {
+			return nil, errors.New("table index is nil")
+		}
+		if data, err = appendValue(data, k, depth+1); err != nil {
+			return nil, err
+		}
+		if data, err = appendValue(data, v, depth+1); err != nil {
+			return nil, err
+		}
+	}
+	return append(data, typeNil), nil
+}
+
+func appendValue(data []byte, v any, depth int) ([]byte, error) {
+	if depth > MaxDepth {
+		return nil, ErrTooDepth
+	}
+
+	switch val := v.(type) {
+	case nil:
+		return append(data, typeNil), nil
+	case bool:
+		if val {
+			return append(data, combineType(typeBoolean, 1)), nil
+		}
+		return append(data, combineType(typeBoolean, 0)), nil
+	case int:
+		return appendInteger(data, int64(val)), nil
+	case int8:
+		return appendInteger(data, int64(val)), nil
+	case int16:
+		return appendInteger(data, int64(val)), nil
+	case int32:
+		return appendInteger(data, int64(val)), nil
+	case int64:
+		return appendInteger(data, val), nil
+	case uint:
+		return appendUnsigned(data, uint64(val))
+	case uint8:
+		return appendInteger(data, int64(val)), nil
+	case uint16:
+		return appendInteger(data, int64(val)), nil
+	case uint32:
+		return appendInteger(data, int64(val)), nil
+	case uint64:
+		return appendUnsigned(data, uint64(val))
+	case float32:
+		return appendReal(data, float64(val)), nil
+	case float64:
+		return appendReal(data, val), nil
+	case string:
+		return appendString(data, val), nil
+	case []byte:
+		return appendString(data, string(val)), nil
+	case LightUserData:
+		data = append(data, combineType(typeUserData, 0))
+		return binary.LittleEndian.AppendUint64(data, uint64(val)), nil
+	case *Table:
+		if val == nil {
+			return append(data, typeNil), nil
+		}
+		return appendTable(data, val, depth)
+	case Table:
+		return appendTable(data, &val, depth)
+	case []any:
+		return appendTable(data, &Table{Array: val}, depth)
+	case map[any]any:
+		return appendTable(data, &Table{Hash: val}, depth)
+	case map[string]any:
+		hash := make(map[any]any, len(val))
+		for k, v := range val {
+			hash[k] = v
+		}
+		return appendTable(data, &Table{Hash: hash}, depth)
+	default:
+		// 其他类型按 Marshal 的规则转换
+		lv, err := ToLua(v)
+		if err != nil {
+			return nil, err
+		}
+		return appendValue(data, lv, depth)
+	}
+}
+
+func (src *bytesSource) ReadByte() (byte, error) {
+	if len(src.data) == 0 {
+		return 0, errors.New("no enough data")
+	}
+	b := src.data[0]
+	src.data = src.data[1:]
+	return b, nil
+}
+
+func (src *bytesSource) Next(n int) ([]byte, error) {
+	if n < 0 || len(src.data) < n {
+		return nil, fmt.Errorf("no enough data need=%d remain=%d", n, len(src.data))
+	}
+	p := src.data[:n]
+	src.data = src.data[n:]
+	return p, nil
+}
+
+func invalidStream(vType, cookie uint8) error {
+	return fmt.Errorf("invalid serialize stream (type=%d,cookie=%d)", vType, cookie)
+}
+
+func (d *decoder) integer(cookie uint8) (int64, error) {
+	switch cookie {
+	case typeNumberZero:
+		return 0, nil
+	case typeNumberByte:
+		b, err := d.src.ReadByte()
+		return int64(b), err
+	case typeNumberWord:
+		p, err := d.src.Next(2)
+		if err != nil {
+			return 0, err
+		}
+		return int64(binary.LittleEndian.Uint16(p)), nil
+	case typeNumberDword:
+		p, err := d.src.Next(4)
+		if err != nil {
+			return 0, err
+		}
+		return int64(int32(binary.LittleEndian.Uint32(p))), nil
+	case typeNumberQword:
+		p, err := d.src.Next(8)
+		if err != nil {
+			return 0, err
+		}
+		return int64(binary.LittleEndian.Uint64(p)), nil
+	default:
+		return 0, invalidStream(typeNumber, cookie)
+	}
+}
+
+func (d *decoder) string(sz int) (string, error) {
+	// netpoll.Reader 直接读出 string, 跨多个节点时只复制一次
+	if src, ok := d.src.(stringSource); ok {
+		return src.ReadString(sz)
+	}
+	p, err := d.src.Next(sz)
+	if err != nil {
+		return "", err
+	}
+	return string(p), nil
+}
+
+func (d *decoder) table(arraySize int) (*Table, error) {
+	if arraySize == maxCookie-1 {
+		header, err := d.src.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		vType, cookie := header&0x7, header>>3
+		if vType != typeNumber || cookie == typeNumberReal {
+			return nil, invalidStream(vType, cookie)
+		}
+		n, err := d.integer(cookie)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, invalidStream(vType, cookie)
+		}
+		arraySize = int(n)
+	}
+
+	d.depth++
+	defer func() { d.depth-- }()
+	if d.depth > MaxDepth {
+		return nil, ErrTooDepth
+	}
+
+	t := &Table{}
+	if arraySize > 0 {
+		t.Array = make([]any, 0, min(arraySize, 1024))
+	}
+	for i := 0; i < arraySize; i++ {
+		v, err := d.next()
+		if err != nil {
+			return nil, err
+		}
+		t.Array = append(t.Array, v)
+	}
 	for {
-		datasz := len(data)
-		if datasz <= 0 {
-			return strs, nil
+		k, err := d.next()
+		if err != nil {
+			return nil, err
 		}
-		header := data[0]
-		vType := header & 0x7
-		vLen := byte(header >> 3)
-		if datasz < int(vLen+1) {
-			return nil, fmt.Errorf("unpackString datasz=%d,vLen=%d", datasz, vLen)
+		if k == nil {
+			return t, nil
 		}
+		v, err := d.next()
+		if err != nil {
+			return nil, err
+		}
+		if t.Hash == nil {
+			t.Hash = make(map[any]any)
+		}
+		t.Hash[k] = v
+	}
+}
+
+func (d *decoder) next() (any, error) {
+	header, err := d.src.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	return d.value(header&0x7, header>>3)
+}
 
-		switch vType {
+func (d *decoder) value(vType, cookie uint8) (any, error) {
+	switch vType {
+	case typeNil:
+		return nil, nil
+	case typeBoolean:
+		return cookie != 0, nil
+	case typeNumber:
+		if cookie == typeNumberReal {
+			p, err := d.src.Next(8)
+			if err != nil {
+				return nil, err
+			}
+			return math.Float64frombits(binary.LittleEndian.Uint64(p)), nil
+		}
+		return d.integer(cookie)
+	case typeUserData:
+		p, err := d.src.Next(8)
+		if err != nil {
+			return nil, err
+		}
+		return LightUserData(binary.LittleEndian.Uint64(p)), nil
+	case typeShortString:
+		return d.string(int(cookie))
+	case typeLongString:
+		var sz int
+		switch cookie {
+		case 2:
+			p, err := d.src.Next(2)
+			if err != nil {
+				return nil, err
+			}
+			sz = int(binary.LittleEndian.Uint16(p))
 		case 4:
-			// 短字符串
-			strLen := int(vLen)
-			start := 1
-			end := start + strLen + 1
-			s := data[start:end]
-			strs = append(strs, string(s))
-			data = data[end:]
-			continue
-		case 5:
-			// 长字符串
-			if vLen == 2 || vLen == 4 {
-				headerLen := data[1 : vLen+1]
-				var strLen int
-				if vLen == 2 {
-					strLen = int(binary.LittleEndian.Uint16(headerLen))
-				} else {
-					strLen = int(binary.LittleEndian.Uint32(headerLen))
-				}
-				start := int(1 + vLen)
-				end := start + strLen + 1
-				s := data[start:end]
-				strs = append(strs, string(s))
-				data = data[end:]
-				continue
-			} else {
-				errmsg := fmt.Sprintf("nonsupport data invalid stream (type=%d,cookie=%d)", vType, vLen)
-				return nil, errors.New(errmsg)
+			p, err := d.src.Next(4)
+			if err != nil {
+				return nil, err
 			}
+			sz = int(binary.LittleEndian.Uint32(p))
 		default:
-			errmsg := fmt.Sprintf("nonsupport data unpack (type=%d)", vType)
-			return nil, errors.New(errmsg)
+			return nil, invalidStream(vType, cookie)
 		}
+		return d.string(sz)
+	case typeTable:
+		return d.table(int(cookie))
+	default:
+		return nil, invalidStream(vType, cookie)
+	}
+}
+
+func packString(strs ...string) []byte {
+	var data []byte
+	for _, s := range strs {
+		data = appendString(data, s)
 	}
+	return data
 }
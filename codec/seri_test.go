@@ -0,0 +1,116 @@
+package codec
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPackInteger(t *testing.T) {
+	cases := []struct {
+		v    int64
+		want []byte
+	}{
+		{0, []byte{0x02}},
+		{1, []byte{0x0a, 0x01}},
+		{0x1234, []byte{0x12, 0x34, 0x12}},
+		{0x12345, []byte{0x22, 0x45, 0x23, 0x01, 0x00}},
+		{-1, []byte{0x22, 0xff, 0xff, 0xff, 0xff}},
+		{math.MaxInt64, []byte{0x32, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}},
+	}
+	for _, c := range cases {
+		data, err := Pack(c.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, c.want) {
+			t.Errorf("pack %d got %x want %x", c.v, data, c.want)
+		}
+		values, err := Unpack(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(values) != 1 || values[0] != c.v {
+			t.Errorf("unpack %x got %v want %d", data, values, c.v)
+		}
+	}
+}
+
+func TestPackUnsigned(t *testing.T) {
+	for _, v := range []any{uint(math.MaxInt64), uint64(math.MaxInt64), uint32(math.MaxUint32)} {
+		data, err := Pack(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values, err := Unpack(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(values) != 1 || uint64(values[0].(int64)) != reflect.ValueOf(v).Uint() {
+			t.Errorf("unpack %v got %v", v, values)
+		}
+	}
+	// lua-seri 只能保存 int64
+	for _, v := range []any{uint(math.MaxInt64 + 1), uint64(math.MaxUint64)} {
+		if _, err := Pack(v); err == nil {
+			t.Errorf("pack %v expect error", v)
+		}
+	}
+}
+
+func TestPackValues(t *testing.T) {
+	long := strings.Repeat("x", 0x10001)
+	nested := &Table{
+		Array: []any{int64(1), "two", 3.5, true},
+		Hash: map[any]any{
+			"name":   "skynet",
+			int64(9): false,
+			"sub":    &Table{Array: []any{long}},
+		},
+	}
+	big := &Table{}
+	for i := 0; i < 100; i++ {
+		big.Array = append(big.Array, int64(i))
+	}
+
+	values := []any{nil, true, false, 1.25, "short", strings.Repeat("y", 40), long, LightUserData(0xdeadbeef), nested, big}
+	data, err := Pack(values...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Unpack(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, values) {
+		t.Errorf("unpack got %v want %v", got, values)
+	}
+}
+
+func TestPackDepth(t *testing.T) {
+	root := &Table{}
+	cur := root
+	for i := 0; i < MaxDepth+1; i++ {
+		sub := &Table{}
+		cur.Array = []any{sub}
+		cur = sub
+	}
+	if _, err := Pack(root); err != ErrTooDepth {
+		t.Errorf("pack depth got %v want %v", err, ErrTooDepth)
+	}
+}
+
+func TestUnpackInvalid(t *testing.T) {
+	for _, data := range [][]byte{
+		{0x07},             // unknown type
+		{0x2d},             // long string with invalid cookie
+		{0x14, 'a'},        // short string truncated
+		{0x16, 0x02, 0x00}, // table without nil terminator
+	} {
+		if _, err := Unpack(data); err == nil {
+			t.Errorf("unpack %x expect error", data)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package skynetclusterd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	ConfigLua  = "lua"
+	ConfigJson = "json"
+	ConfigYaml = "yaml"
+
+	noWaitingKey = "__nowaiting"
+)
+
+type (
+	// ClusterConfig skynet clustername.lua 的内容
+	//
+	//	__nowaiting = true
+	//	node1 = "127.0.0.1:2528"
+	//	node2 = false
+	ClusterConfig struct {
+		Nodes     map[string]string // name -> addr, addr 为空表示 node = false 下线
+		NoWaiting *bool             // 未配置时为 nil
+	}
+
+	// luaLexer 只支持 clustername.lua 用到的 lua 子集: 赋值语句, 字符串, 布尔值, nil 和注释
+	luaLexer struct {
+		data []byte
+		pos  int
+		line int
+	}
+)
+
+// LoadConfigFile 按扩展名 (.lua/.json/.yaml/.yml) 解析配置文件, 其他扩展名按 lua 解析
+func LoadConfigFile(path string) (*ClusterConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfigFile(path, data)
+}
+
+// formatFor 按文件扩展名选择配置格式, 默认为 clustername.lua 的格式
+func formatFor(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return ConfigJson
+	case ".yaml", ".yml":
+		return ConfigYaml
+	}
+	return ConfigLua
+}
+
+// parseConfigFile 解析已经读出的配置文件内容, 错误带上文件路径
+func parseConfigFile(path string, data []byte) (*ClusterConfig, error) {
+	conf, err := ParseConfig(data, formatFor(path))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return conf, nil
+}
+
+// ReloadConfigFile 加载配置文件并注册到节点表, 对应 cluster.reload
+func (c *Cluster) ReloadConfigFile(path string) error {
+	conf, err := LoadConfigFile(path)
+	if err != nil {
+		return err
+	}
+	c.ApplyConfig(conf)
+	return nil
+}
+
+func ReloadConfigFile(path string) error {
+	return defaultCluster.ReloadConfigFile(path)
+}
+
+// ApplyConfig 注册配置中的节点, 配置中没有的节点保持不变
+func (c *Cluster) ApplyConfig(conf *ClusterConfig) {
+	c.reloadConfig(nil, conf)
+}
+
+func ApplyConfig(conf *ClusterConfig) {
+	defaultCluster.ApplyConfig(conf)
+}
+
+func ParseConfig(data []byte, format string) (*ClusterConfig, error) {
+	var values map[string]any
+	var err error
+	switch format {
+	case ConfigLua:
+		values, err = parseLuaConfig(data)
+	case ConfigJson:
+		err = json.Unmarshal(data, &values)
+	case ConfigYaml:
+		err = yaml.Unmarshal(data, &values)
+	default:
+		err = fmt.Errorf("unknown config format %s", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &ClusterConfig{
+		Nodes: make(map[string]string),
+	}
+	for name, value := range values {
+		if name == noWaitingKey {
+			nowaiting, ok := value.(bool)
+			if !ok {
+				return nil, fmt.Errorf("invalid %s value %v", noWaitingKey, value)
+			}
+			conf.NoWaiting = &nowaiting
+			continue
+		}
+		// __ 开头的是保留的配置项, 不是节点名
+		if strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("unknown config key %s", name)
+		}
+		switch v := value.(type) {
+		case nil:
+			// name = nil 等同于没有配置
+		case string:
+			// 加载时检查地址格式, 不要等到第一次连接时才失败
+			if _, port, err := net.SplitHostPort(v); err != nil || port == "" {
+				return nil, fmt.Errorf("invalid node %s address %q", name, v)
+			}
+			conf.Nodes[name] = v
+		case bool:
+			if v {
+				return nil, fmt.Errorf("invalid node %s value true", name)
+			}
+			conf.Nodes[name] = ""
+		default:
+			return nil, fmt.Errorf("invalid node %s value %v", name, value)
+		}
+	}
+	return conf, nil
+}
+
+func parseLuaConfig(data []byte) (map[string]any, error) {
+	lex := &luaLexer{data: data, line: 1}
+	values := make(map[string]any)
+	for {
+		lex.skipSpace()
+		if lex.eof() {
+			return values, nil
+		}
+		name, err := lex.name()
+		if err != nil {
+			return nil, err
+		}
+		lex.skipSpace()
+		if !lex.accept('=') {
+			return nil, lex.errorf("'=' expected near %s", name)
+		}
+		lex.skipSpace()
+		value, err := lex.value()
+		if err != nil {
+			return nil, err
+		}
+		values[name] = value
+		lex.skipSpace()
+		if !lex.accept(';') {
+			lex.accept(',')
+		}
+	}
+}
+
+func (lex *luaLexer) errorf(format string, args ...any) error {
+	return fmt.Errorf("line %d: %s", lex.line, fmt.Sprintf(format, args...))
+}
+
+func (lex *luaLexer) eof() bool {
+	return lex.pos >= len(lex.data)
+}
+
+func (lex *luaLexer) peek(offset int) byte {
+	if lex.pos+offset >= len(lex.data) {
+		return 0
+	}
+	return lex.data[lex.pos+offset]
+}
+
+func (lex *luaLexer) accept(c byte) bool {
+	if lex.peek(0) == c && !lex.eof() {
+		lex.pos++
+		return true
+	}
+	return false
+}
+
+// skipSpace 跳过空白和注释
+func (lex *luaLexer) skipSpace() {
+	for !lex.eof() {
+		c := lex.peek(0)
+		switch {
+		case c == '\n':
+			lex.line++
+			lex.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			lex.pos++
+		case c == '-' && lex.peek(1) == '-':
+			lex.pos += 2
+			if lex.peek(0) == '[' {
+				if _, ok := lex.longBracket(); ok {
+					continue
+				}
+			}
+			for !lex.eof() && lex.peek(0) != '\n' {
+				lex.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// longBracket 解析 [[...]] 或 [==[...]==], 不是长括号时不移动位置
+func (lex *luaLexer) longBracket() (string, bool) {
+	start := lex.pos
+	if !lex.accept('[') {
+		return "", false
+	}
+	level := 0
+	for lex.accept('=') {
+		level++
+	}
+	if !lex.accept('[') {
+		lex.pos = start
+		return "", false
+	}
+	closing := "]" + strings.Repeat("=", level) + "]"
+	end := strings.Index(string(lex.data[lex.pos:]), closing)
+	if end < 0 {
+		lex.pos = len(lex.data)
+		return "", false
+	}
+	s := string(lex.data[lex.pos : lex.pos+end])
+	lex.line += strings.Count(s, "\n")
+	lex.pos += end + len(closing)
+	// 紧跟在开始括号后的换行会被忽略
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "\r"), "\n")
+	return s, true
+}
+
+func isNameChar(c byte, first bool) bool {
+	if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+		return true
+	}
+	return !first && c >= '0' && c <= '9'
+}
+
+// name 解析 name 或者 ["name"]
+func (lex *luaLexer) name() (string, error) {
+	if lex.peek(0) == '[' {
+		lex.pos++
+		lex.skipSpace()
+		key, err := lex.value()
+		if err != nil {
+			return "", err
+		}
+		name, ok := key.(string)
+		if !ok {
+			return "", lex.errorf("invalid node name %v", key)
+		}
+		lex.skipSpace()
+		if !lex.accept(']') {
+			return "", lex.errorf("']' expected")
+		}
+		return name, nil
+	}
+	start := lex.pos
+	for !lex.eof() && isNameChar(lex.peek(0), lex.pos == start) {
+		lex.pos++
+	}
+	if start == lex.pos {
+		return "", lex.errorf("unexpected symbol near '%c'", lex.peek(0))
+	}
+	return string(lex.data[start:lex.pos]), nil
+}
+
+func (lex *luaLexer) value() (any, error) {
+	c := lex.peek(0)
+	switch {
+	case c == '"' || c == '\'':
+		return lex.quoted()
+	case c == '[':
+		s, ok := lex.longBracket()
+		if !ok {
+			return nil, lex.errorf("unfinished long string")
+		}
+		return s, nil
+	case isNameChar(c, true):
+		start := lex.pos
+		for !lex.eof() && isNameChar(lex.peek(0), false) {
+			lex.pos++
+		}
+		switch word := string(lex.data[start:lex.pos]); word {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "nil":
+			return nil, nil
+		default:
+			return nil, lex.errorf("unsupport value %s", word)
+		}
+	default:
+		return nil, lex.errorf("unexpected symbol near '%c'", c)
+	}
+}
+
+func (lex *luaLexer) quoted() (string, error) {
+	quote := lex.data[lex.pos]
+	lex.pos++
+	var sb strings.Builder
+	for {
+		if lex.eof() {
+			return "", lex.errorf("unfinished string")
+		}
+		c := lex.data[lex.pos]
+		lex.pos++
+		switch c {
+		case quote:
+			return sb.String(), nil
+		case '\n':
+			return "", lex.errorf("unfinished string")
+		case '\\':
+			if lex.eof() {
+				return "", lex.errorf("unfinished string")
+			}
+			e := lex.data[lex.pos]
+			lex.pos++
+			switch e {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case 'r':
+				sb.WriteByte('\r')
+			case '\\', '"', '\'':
+				sb.WriteByte(e)
+			default:
+				if e < '0' || e > '9' {
+					return "", lex.errorf("invalid escape sequence '\\%c'", e)
+				}
+				// \ddd
+				end := lex.pos - 1
+				for end < len(lex.data) && end < lex.pos+2 && lex.data[end] >= '0' && lex.data[end] <= '9' {
+					end++
+				}
+				n, err := strconv.Atoi(string(lex.data[lex.pos-1 : end]))
+				if err != nil || n > 255 {
+					return "", lex.errorf("decimal escape too large")
+				}
+				sb.WriteByte(byte(n))
+				lex.pos = end
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package skynetclusterd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseLuaConfig(t *testing.T) {
+	data := []byte(`
+-- clustername.lua
+__nowaiting = true
+node1 = "127.0.0.1:2528"
+node2 = false --[[ 下线 ]]
+['node3'] = '127.0.0.1:2529';
+node4 = [[127.0.0.1:2530]]
+node5 = nil
+node6 = "\049\050\055.0.0.1:2531"
+`)
+	conf, err := ParseConfig(data, ConfigLua)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"node1": "127.0.0.1:2528",
+		"node2": "",
+		"node3": "127.0.0.1:2529",
+		"node4": "127.0.0.1:2530",
+		"node6": "127.0.0.1:2531",
+	}
+	if !reflect.DeepEqual(conf.Nodes, want) {
+		t.Errorf("nodes got %v want %v", conf.Nodes, want)
+	}
+	if conf.NoWaiting == nil || !*conf.NoWaiting {
+		t.Errorf("nowaiting got %v", conf.NoWaiting)
+	}
+
+	for _, invalid := range []string{
+		`node1 = "127.0.0.1`,
+		`node1 "127.0.0.1"`,
+		`node1 = 2528`,
+		`node1 = true`,
+		`__nowaiting = "yes"`,
+		`__nowait = true`,
+		`__node1 = "127.0.0.1:2528"`,
+		`node1 = "127.0.0.1"`,
+		`node1 = "127.0.0.1:"`,
+		`node1 = ""`,
+	} {
+		if _, err := ParseConfig([]byte(invalid), ConfigLua); err == nil {
+			t.Errorf("parse %q expect error", invalid)
+		}
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"cluster.json": `{"__nowaiting": false, "node1": "127.0.0.1:2528", "node2": false}`,
+		"cluster.yaml": "__nowaiting: false\nnode1: 127.0.0.1:2528\nnode2: false\n",
+		"cluster.lua":  "__nowaiting = false\nnode1 = \"127.0.0.1:2528\"\nnode2 = false\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		conf, err := LoadConfigFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]string{"node1": "127.0.0.1:2528", "node2": ""}
+		if !reflect.DeepEqual(conf.Nodes, want) || conf.NoWaiting == nil || *conf.NoWaiting {
+			t.Errorf("%s got %v %v", name, conf.Nodes, conf.NoWaiting)
+		}
+	}
+}
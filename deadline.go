@@ -0,0 +1,102 @@
+package skynetclusterd
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/changlongH/skynet_cluster/codec"
+)
+
+// 请求的超时时间按 "__dl:剩余毫秒:服务名" 的格式放在服务名中发送
+// 只有握手成功的链接才使用, 普通的 skynet 节点不受影响
+const (
+	// deadlineService 建立链接后发送的握手请求, 支持的节点返回 deadlineVersion, 其他节点返回错误
+	deadlineService = "__deadline__"
+	deadlinePrefix  = "__dl:"
+	deadlineVersion = 1
+
+	maxServiceName = 0xff // 字符串地址的长度为一个字节
+)
+
+// WithDeadlinePropagation 建立链接时和对方握手, 对方支持时 Call 把 ctx 的剩余时间发送给对方
+// 对方处理请求的 ctx 在调用方放弃等待时结束; 接收方总是支持, 不需要设置
+func WithDeadlinePropagation() Option {
+	return func(c *Cluster) {
+		c.propagateDeadline = true
+	}
+}
+
+// negotiate 发送握手请求, 对方返回错误或者超时时不使用 deadline
+func (agent *SenderAgent) negotiate(parent context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+
+	pack := &codec.ReqPack{
+		Addr: codec.Addr{Name: deadlineService},
+		Cmd:  "hello",
+		Args: []any{int64(deadlineVersion)},
+	}
+	// 握手不受 WithMaxInFlight 限制, 避免建立链接失败
+	agent.limiter.reserve(1, 0)
+	req := newRequest()
+	pack.Session = agent.sessions.add(req)
+	if err := agent.PostRequest(pack); err != nil {
+		agent.sessions.remove(pack.Session)
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		agent.cancel(pack.Session)
+		if parent.Err() != nil {
+			return ctxErr(parent)
+		}
+		agent.logger.Warn("deadline handshake timeout")
+		return nil
+	case msg, ok := <-req.RespCh:
+		if !ok {
+			return req.err
+		}
+		if msg.Ok && len(msg.Results) > 0 && msg.Results[0] == int64(deadlineVersion) {
+			agent.deadline = true
+		}
+		return nil
+	}
+}
+
+// withDeadline 握手成功的链接上, ctx 有超时时间的请求在服务名中带上剩余时间
+// 返回的 pack 只用于编码, 原来的 pack 不变
+func (agent *SenderAgent) withDeadline(ctx context.Context, pack *codec.ReqPack) *codec.ReqPack {
+	deadline, ok := ctx.Deadline()
+	if !agent.deadline || !ok || pack.Addr.Name == "" {
+		return pack
+	}
+	ms := max(time.Until(deadline).Milliseconds(), 1)
+	name := deadlinePrefix + strconv.FormatInt(ms, 10) + ":" + pack.Addr.Name
+	if len(name) > maxServiceName {
+		return pack
+	}
+	wire := *pack
+	wire.Addr.Name = name
+	return &wire
+}
+
+// parseDeadline 去掉服务名中的剩余时间, 返回请求的超时时间, 没有时返回零值
+func parseDeadline(msg *codec.ReqPack) time.Time {
+	rest, ok := strings.CutPrefix(msg.Addr.Name, deadlinePrefix)
+	if !ok {
+		return time.Time{}
+	}
+	value, name, ok := strings.Cut(rest, ":")
+	if !ok {
+		return time.Time{}
+	}
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ms <= 0 {
+		return time.Time{}
+	}
+	msg.Addr.Name = strings.TrimPrefix(name, "@")
+	return time.Now().Add(time.Duration(ms) * time.Millisecond)
+}
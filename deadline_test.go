@@ -0,0 +1,124 @@
+package skynetclusterd
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/changlongH/skynet_cluster/codec"
+	"github.com/cloudwego/netpoll"
+)
+
+func TestDeadlinePropagation(t *testing.T) {
+	server := New()
+	addr := listenTestCluster(t, server)
+	defer server.Shutdown(context.Background())
+
+	type seen struct {
+		hasDeadline bool
+		err         error
+	}
+	seenCh := make(chan seen, 1)
+	svc := NewService("dl")
+	svc.Handle("wait", func(ctx context.Context, args []byte) ([]byte, error) {
+		_, ok := ctx.Deadline()
+		timeout := time.After(300 * time.Millisecond)
+		select {
+		case <-ctx.Done():
+			seenCh <- seen{ok, ctx.Err()}
+			<-timeout
+		case <-timeout:
+			seenCh <- seen{ok, ctx.Err()}
+		}
+		return args, nil
+	})
+	server.RegisterService(svc)
+
+	propagate, plain := New(WithDeadlinePropagation()), New()
+	for _, c := range []*Cluster{propagate, plain} {
+		c.RegisterNode("server", addr)
+		defer c.Shutdown(context.Background())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := propagate.CallMulti(ctx, "server", "dl", "wait"); !errors.Is(err, ErrTimeout) {
+		t.Errorf("call got %v", err)
+	}
+	if s := <-seenCh; !s.hasDeadline || !errors.Is(s.err, context.DeadlineExceeded) {
+		t.Errorf("handler with deadline got %+v", s)
+	}
+
+	// 没有开启时和原来一样
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := plain.CallMulti(ctx, "server", "dl", "wait"); err != nil {
+		t.Error(err)
+	}
+	if s := <-seenCh; s.hasDeadline || s.err != nil {
+		t.Errorf("handler without deadline got %+v", s)
+	}
+}
+
+// TestDeadlinePlainPeer 对方不支持时握手返回错误, 请求的服务名不变
+func TestDeadlinePlainPeer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	names := make(chan string, 2)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		large := map[uint32]*codec.ReqPack{}
+		for {
+			header := make([]byte, 2)
+			if _, err := io.ReadFull(conn, header); err != nil {
+				return
+			}
+			body := make([]byte, binary.BigEndian.Uint16(header))
+			if _, err := io.ReadFull(conn, body); err != nil {
+				return
+			}
+			pkg := netpoll.NewLinkBuffer()
+			pkg.WriteBinary(body)
+			pkg.Flush()
+			msg, err := codec.DecodeReq(pkg, large)
+			if err != nil || msg == nil {
+				continue
+			}
+			names <- msg.Addr.Name
+			resp := &codec.RespPack{Session: msg.Session, Ok: true, Results: []any{"ok"}}
+			if msg.Addr.Name == deadlineService {
+				resp = &codec.RespPack{Session: msg.Session, Message: []byte("Invalid name")}
+			}
+			buf := netpoll.NewLinkBuffer()
+			codec.EncodeResp(buf, resp)
+			data, _ := buf.Next(buf.Len())
+			conn.Write(data)
+		}
+	}()
+
+	client := New(WithDeadlinePropagation())
+	client.RegisterNode("skynet", ln.Addr().String())
+	defer client.Shutdown(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if results, err := client.CallMulti(ctx, "skynet", "db", "get"); err != nil || results[0] != "ok" {
+		t.Fatalf("call got %v %v", results, err)
+	}
+	if name := <-names; name != deadlineService {
+		t.Errorf("handshake got %q", name)
+	}
+	if name := <-names; name != "db" {
+		t.Errorf("request service name got %q", name)
+	}
+}
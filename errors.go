@@ -0,0 +1,37 @@
+package skynetclusterd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrNodeNotFound = errors.New("not found tcp addr node")
+	ErrTimeout      = errors.New("timeout")
+	ErrConnClosed   = errors.New("socket close")
+	ErrNodeChanged  = errors.New("cluster node address changed")
+	ErrNodeDown     = errors.New("cluster node is down")
+	ErrShutdown     = errors.New("cluster shutdown")
+	ErrOverloaded   = errors.New("cluster node overloaded")
+)
+
+// ctxErr 超时返回 ErrTimeout, 其他情况返回 ctx.Err()
+func ctxErr(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+	return ctx.Err()
+}
+
+// RemoteError 远端服务处理请求失败返回的错误 (lua error 或者 handler 返回的 error)
+type RemoteError struct {
+	Node    string
+	Service string
+	Cmd     string
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("remote error node:%s service:%s cmd:%s %s", e.Node, e.Service, e.Cmd, e.Message)
+}
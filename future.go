@@ -0,0 +1,186 @@
+package skynetclusterd
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/changlongH/skynet_cluster/codec"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Future CallAsync 的结果, 回应由链接的 WaitResponse 直接写入, 不会为每个请求创建 goroutine
+type Future struct {
+	c     *Cluster
+	node  string
+	pack  *codec.ReqPack
+	start time.Time
+	span  trace.Span
+
+	mu        sync.Mutex
+	done      chan struct{}
+	finished  bool
+	stop      func() bool // 取消 ctx 的 AfterFunc
+	callbacks []func(results []any, err error)
+	results   []any
+	err       error
+}
+
+// CallAsync 同 CallMulti, 发出请求后立即返回, 节点还没有链接或者超过 WithMaxInFlight 等限制时会先等待
+// ctx 结束时请求返回 ErrTimeout 或者 ctx.Err(), 和 Call 一样释放 session
+func (c *Cluster) CallAsync(ctx context.Context, node, service, cmd string, args ...any) *Future {
+	if args == nil {
+		args = []any{}
+	}
+	pack := &codec.ReqPack{
+		Addr: codec.Addr{
+			Id:   0,
+			Name: service,
+		},
+		Cmd:  cmd,
+		Args: args,
+	}
+	f := newFuture(c, node, pack)
+	ctx = f.begin(ctx)
+
+	req := &Request{callback: f.complete}
+	agent, err := c.post(ctx, node, pack, req)
+	if err != nil {
+		f.complete(nil, err)
+		return f
+	}
+	f.watch(ctx, agent)
+	return f
+}
+
+func CallAsync(ctx context.Context, node, service, cmd string, args ...any) *Future {
+	return defaultCluster.CallAsync(ctx, node, service, cmd, args...)
+}
+
+func newFuture(c *Cluster, node string, pack *codec.ReqPack) *Future {
+	return &Future{
+		c:    c,
+		node: node,
+		pack: pack,
+		done: make(chan struct{}),
+	}
+}
+
+// begin 发送请求前开始计时并创建 span
+func (f *Future) begin(ctx context.Context) context.Context {
+	f.start = time.Now()
+	ctx, f.span = f.c.startSpan(ctx, trace.SpanKindClient, f.pack, attrNode.String(f.node))
+	return ctx
+}
+
+// watch 请求发出后 ctx 结束时释放 session 并返回 ctx 的错误
+func (f *Future) watch(ctx context.Context, agent *SenderAgent) {
+	session := f.pack.Session
+	stop := context.AfterFunc(ctx, func() {
+		if agent.cancel(session) {
+			f.complete(nil, ctxErr(ctx))
+		}
+	})
+	f.mu.Lock()
+	if f.finished {
+		f.mu.Unlock()
+		stop()
+		return
+	}
+	f.stop = stop
+	f.mu.Unlock()
+}
+
+// complete 只有第一次调用生效, msg 和 err 同 Request.callback
+func (f *Future) complete(msg *codec.RespPack, err error) {
+	var results []any
+	if err == nil {
+		if err = remoteError(f.node, f.pack, msg); err == nil {
+			results = msg.Results
+		}
+	}
+
+	f.mu.Lock()
+	if f.finished {
+		f.mu.Unlock()
+		return
+	}
+	f.finished = true
+	f.results, f.err = results, err
+	stop, callbacks := f.stop, f.callbacks
+	f.stop, f.callbacks = nil, nil
+	close(f.done)
+	f.mu.Unlock()
+
+	if stop != nil {
+		stop()
+	}
+	setSpanPack(f.span, f.pack)
+	endSpan(f.span, err)
+	f.c.metrics.CallDone(f.node, serviceName(f.pack.Addr), f.pack.Cmd, time.Since(f.start), err)
+	for _, fn := range callbacks {
+		fn(results, err)
+	}
+}
+
+// Done 请求完成后关闭
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait 等待请求完成, 返回值同 CallMulti
+// ctx 只限制这次等待, 结束时返回 ctx 的错误, 请求本身不受影响
+func (f *Future) Wait(ctx context.Context) ([]any, error) {
+	select {
+	case <-f.done:
+		return f.results, f.err
+	case <-ctx.Done():
+		return nil, ctxErr(ctx)
+	}
+}
+
+// OnDone 注册请求完成的回调, 已经完成时直接在当前 goroutine 调用
+// 回调在收到回应的链接 goroutine 中执行, 不能阻塞, 耗时的操作需要自己开 goroutine
+func (f *Future) OnDone(fn func(results []any, err error)) {
+	f.mu.Lock()
+	if !f.finished {
+		f.callbacks = append(f.callbacks, fn)
+		f.mu.Unlock()
+		return
+	}
+	f.mu.Unlock()
+	fn(f.results, f.err)
+}
+
+// WaitAll 等待所有请求完成, 返回第一个失败的请求的错误 (按参数顺序)
+func WaitAll(ctx context.Context, futures ...*Future) error {
+	for _, f := range futures {
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return ctxErr(ctx)
+		}
+	}
+	for _, f := range futures {
+		if f.err != nil {
+			return f.err
+		}
+	}
+	return nil
+}
+
+// WaitAny 等待任意一个请求完成, 返回它在参数中的下标, 结果用 futures[i].Wait 获取
+// ctx 结束时返回 -1
+func WaitAny(ctx context.Context, futures ...*Future) (int, error) {
+	cases := make([]reflect.SelectCase, 0, len(futures)+1)
+	for _, f := range futures {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(f.done)})
+	}
+	cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())})
+	i, _, _ := reflect.Select(cases)
+	if i == len(futures) {
+		return -1, ctxErr(ctx)
+	}
+	return i, nil
+}
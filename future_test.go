@@ -0,0 +1,110 @@
+package skynetclusterd
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCallAsync(t *testing.T) {
+	server, client := New(), New()
+	addr := listenTestCluster(t, server)
+	client.RegisterNode("server", addr)
+	defer client.Shutdown(context.Background())
+	defer server.Shutdown(context.Background())
+
+	svc := NewService("async")
+	svc.HandleMulti("echo", func(ctx context.Context, args []any) ([]any, error) {
+		return args, nil
+	})
+	svc.HandleMulti("fail", func(ctx context.Context, args []any) ([]any, error) {
+		return nil, errors.New("oops")
+	})
+	svc.HandleMulti("sleep", func(ctx context.Context, args []any) ([]any, error) {
+		time.Sleep(200 * time.Millisecond)
+		return args, nil
+	})
+	server.RegisterService(svc)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	// 同时发出多个请求, 回调和 Wait 都能拿到结果
+	const n = 10
+	futures := make([]*Future, n)
+	callbacks := make(chan int64, n)
+	for i := range futures {
+		futures[i] = client.CallAsync(ctx, "server", "async", "echo", int64(i))
+		futures[i].OnDone(func(results []any, err error) {
+			if err == nil {
+				callbacks <- results[0].(int64)
+			}
+		})
+	}
+	if err := WaitAll(ctx, futures...); err != nil {
+		t.Fatal(err)
+	}
+	for i, f := range futures {
+		results, err := f.Wait(ctx)
+		if err != nil || len(results) != 1 || results[0] != int64(i) {
+			t.Errorf("future %d got %v %v", i, results, err)
+		}
+	}
+	sum := int64(0)
+	for i := 0; i < n; i++ {
+		sum += <-callbacks
+	}
+	if sum != n*(n-1)/2 {
+		t.Errorf("callbacks sum got %d", sum)
+	}
+
+	// 完成之后注册的回调直接调用
+	called := false
+	futures[0].OnDone(func(results []any, err error) { called = true })
+	if !called {
+		t.Error("OnDone after done not called")
+	}
+
+	var remoteErr *RemoteError
+	fail := client.CallAsync(ctx, "server", "async", "fail")
+	if err := WaitAll(ctx, futures[0], fail); !errors.As(err, &remoteErr) || remoteErr.Message != "oops" {
+		t.Errorf("WaitAll got %v", err)
+	}
+
+	// 一个链接上的请求按顺序处理, echo 先完成
+	echo := client.CallAsync(ctx, "server", "async", "echo")
+	sleep := client.CallAsync(ctx, "server", "async", "sleep")
+	if i, err := WaitAny(ctx, sleep, echo); i != 1 || err != nil {
+		t.Errorf("WaitAny got %d %v", i, err)
+	}
+	select {
+	case <-sleep.Done():
+		t.Error("sleep done before echo")
+	default:
+	}
+
+	// Wait 的 ctx 只限制等待, 请求的 ctx 结束时释放 session
+	waitCtx, waitCancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer waitCancel()
+	if _, err := sleep.Wait(waitCtx); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Wait timeout got %v", err)
+	}
+	if _, err := sleep.Wait(ctx); err != nil {
+		t.Errorf("sleep got %v", err)
+	}
+
+	callCtx, callCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer callCancel()
+	timeout := client.CallAsync(callCtx, "server", "async", "sleep")
+	if _, err := timeout.Wait(ctx); !errors.Is(err, ErrTimeout) {
+		t.Errorf("CallAsync timeout got %v", err)
+	}
+	if stats := client.Stats(); len(stats.Senders) != 1 || stats.Senders[0].InFlight != 0 {
+		t.Errorf("stats after timeout got %+v", stats)
+	}
+
+	if _, err := client.CallAsync(ctx, "nobody", "async", "echo").Wait(ctx); !errors.Is(err, ErrNodeNotFound) {
+		t.Errorf("unknown node got %v", err)
+	}
+}
@@ -2,9 +2,20 @@ module github.com/changlongH/skynet_cluster
 
 go 1.22.5
 
-require github.com/cloudwego/netpoll v0.6.4
+require (
+	github.com/cloudwego/netpoll v0.6.4
+	go.opentelemetry.io/otel v1.33.0
+	go.opentelemetry.io/otel/sdk v1.33.0
+	go.opentelemetry.io/otel/trace v1.33.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/bytedance/gopkg v0.1.0 // indirect
-	github.com/stretchr/testify v1.8.1 // indirect
+	github.com/go-logr/logr v1.4.2 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	go.opentelemetry.io/auto/sdk v1.1.0 // indirect
+	go.opentelemetry.io/otel/metric v1.33.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
 )
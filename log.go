@@ -0,0 +1,26 @@
+package skynetclusterd
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// WithLogger 设置日志, 默认使用 slog.Default()
+// 链接相关的日志带有 remote_addr, node, session, type (包类型) 等属性
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *Cluster) {
+		c.logger = logger
+	}
+}
+
+// log 未设置 logger 时使用当前的 slog.Default(), 默认 Cluster 在 init 时创建, 不能提前保存
+func (c *Cluster) log() *slog.Logger {
+	if c.logger != nil {
+		return c.logger
+	}
+	return slog.Default()
+}
+
+func packetTypeAttr(b byte) slog.Attr {
+	return slog.String("type", fmt.Sprintf("0x%02x", b))
+}
@@ -0,0 +1,87 @@
+package skynetclusterd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// logBuffer 并发安全的日志输出, 按行解析 json 日志
+type logBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+// find 返回第一条 msg 相同的日志
+func (b *logBuffer) find(msg string) map[string]any {
+	b.Lock()
+	defer b.Unlock()
+	for _, line := range bytes.Split(b.buf.Bytes(), []byte("\n")) {
+		var entry map[string]any
+		if json.Unmarshal(line, &entry) == nil && entry["msg"] == msg {
+			return entry
+		}
+	}
+	return nil
+}
+
+func (b *logBuffer) wait(t *testing.T, msg string) map[string]any {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if entry := b.find(msg); entry != nil {
+			return entry
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("log %q not found:\n%s", msg, b.buf.String())
+	return nil
+}
+
+func TestLogger(t *testing.T) {
+	serverLog, clientLog := &logBuffer{}, &logBuffer{}
+	newLogger := func(b *logBuffer) *slog.Logger {
+		return slog.New(slog.NewJSONHandler(b, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	}
+	server, client := New(WithLogger(newLogger(serverLog))), New(WithLogger(newLogger(clientLog)))
+	addr := listenTestCluster(t, server)
+	client.RegisterNode("server", addr)
+	defer client.Shutdown(context.Background())
+
+	// 非法的请求包记录包类型和对方地址
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{0, 1, 0x99})
+	entry := serverLog.wait(t, "decode request failed")
+	if entry["type"] != "0x99" || entry["remote_addr"] != conn.LocalAddr().String() || entry["error"] == nil {
+		t.Errorf("decode request failed log got %v", entry)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	client.Call(ctx, "server", "none", "cmd", "")
+	entry = clientLog.wait(t, "connected to node")
+	if entry["node"] != "server" || entry["remote_addr"] != addr {
+		t.Errorf("connected log got %v", entry)
+	}
+
+	// 对方关闭后记录链接断开的原因
+	server.Shutdown(ctx)
+	entry = clientLog.wait(t, "connection closed")
+	if entry["node"] != "server" || entry["reason"] != ErrConnClosed.Error() {
+		t.Errorf("connection closed log got %v", entry)
+	}
+}
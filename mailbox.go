@@ -0,0 +1,173 @@
+package skynetclusterd
+
+import (
+	"context"
+	"time"
+
+	"github.com/changlongH/skynet_cluster/codec"
+)
+
+type (
+	// mailbox 一个服务在一个链接上的请求队列, 由服务自己的 goroutine 按顺序处理
+	// 只在 RecvAgent.Start 中创建, 放入和关闭
+	mailbox struct {
+		agent *RecvAgent
+		ch    chan mail
+	}
+
+	mail struct {
+		msg      *codec.ReqPack
+		deadline time.Time
+	}
+)
+
+const (
+	defaultMailboxSize = 1024
+)
+
+// WithMailbox 每个服务在每个链接上的 mailbox 容量, 默认 1024
+// 收到的请求按服务放入各自的 mailbox, 由服务自己的 goroutine 处理, 同 skynet 的服务模型:
+// 同一个链接上同一个服务的请求按收到的顺序处理, 不同服务的请求并行处理, 一个慢的服务不影响其他服务
+func WithMailbox(size int) Option {
+	return func(c *Cluster) {
+		c.mailboxSize = max(size, 1)
+	}
+}
+
+// WithMailboxPolicy 服务的 mailbox 满时的处理方式, 默认 OverloadBlock
+//   - OverloadBlock: 等待 mailbox 有空位, 期间不再读取这个链接上的请求, 对方的请求在发送端排队
+//   - OverloadFail: 直接回复 ErrOverloaded, 不影响同一个链接上的其他服务
+func WithMailboxPolicy(policy OverloadPolicy) Option {
+	return func(c *Cluster) {
+		c.mailboxPolicy = policy
+	}
+}
+
+// SetWorkers 使用 n 个 goroutine 处理服务在每个链接上的 mailbox, 默认为 1
+// n > 1 时同一个服务的请求可能并行处理, 不再保证顺序, 需要在收到请求前设置
+func (svc *Service) SetWorkers(n int) *Service {
+	svc.Lock()
+	defer svc.Unlock()
+	svc.workers = max(n, 1)
+	return svc
+}
+
+func newMailbox(agent *RecvAgent, size, workers int) *mailbox {
+	mb := &mailbox{
+		agent: agent,
+		ch:    make(chan mail, size),
+	}
+	for i := 0; i < workers; i++ {
+		go mb.run()
+	}
+	return mb
+}
+
+func (mb *mailbox) run() {
+	for m := range mb.ch {
+		// 链接已经关闭或者 Shutdown 超时的请求不再处理
+		if mb.agent.ctx.Err() == nil {
+			mb.agent.dispatch(m.msg, m.deadline)
+		}
+		mb.agent.donePending()
+	}
+}
+
+// post 放入 mailbox, 满时 block 为 true 等待空位, 链接关闭时返回 ErrConnClosed; 否则返回 ErrOverloaded
+func (mb *mailbox) post(msg *codec.ReqPack, deadline time.Time, block bool) error {
+	agent := mb.agent
+	agent.addPending()
+	m := mail{msg, deadline}
+	select {
+	case mb.ch <- m:
+		return nil
+	default:
+	}
+	if !block {
+		agent.donePending()
+		return ErrOverloaded
+	}
+	select {
+	case mb.ch <- m:
+		return nil
+	case <-agent.CloseCh:
+	case <-agent.ctx.Done():
+	}
+	agent.donePending()
+	return ErrConnClosed
+}
+
+// close 已经放入的请求处理完后 goroutine 退出
+func (mb *mailbox) close() {
+	close(mb.ch)
+}
+
+// mailbox 服务在这个链接上的 mailbox, 第一次收到这个服务的请求时创建
+func (agent *RecvAgent) mailbox(svc *Service) *mailbox {
+	mb, ok := agent.mailboxes[svc]
+	if !ok {
+		svc.RLock()
+		workers := max(svc.workers, 1)
+		svc.RUnlock()
+		mb = newMailbox(agent, agent.c.mailboxSize, workers)
+		agent.mailboxes[svc] = mb
+	}
+	return mb
+}
+
+// closeMailboxes Start 退出时关闭这个链接上的所有 mailbox
+func (agent *RecvAgent) closeMailboxes() {
+	for svc, mb := range agent.mailboxes {
+		mb.close()
+		delete(agent.mailboxes, svc)
+	}
+}
+
+// deliver 请求放入服务的 mailbox, 服务不存在时返回 false, 由调用方直接回复错误
+// mailbox 满时按 WithMailboxPolicy 等待, 或者回复 ErrOverloaded
+func (agent *RecvAgent) deliver(msg *codec.ReqPack, deadline time.Time) bool {
+	svc, ok := agent.c.GetService(msg.Addr)
+	if !ok {
+		return false
+	}
+	err := agent.mailbox(svc).post(msg, deadline, agent.c.mailboxPolicy == OverloadBlock)
+	switch err {
+	case nil:
+	case ErrConnClosed:
+		// 链接已经关闭或者 Shutdown 超时, 请求直接丢弃
+	default:
+		agent.logger.Warn("service mailbox full", "service", serviceName(msg.Addr), "cmd", msg.Cmd,
+			"session", msg.Session)
+		if msg.Session > 0 {
+			agent.Response(&codec.RespPack{
+				Session: msg.Session,
+				Ok:      false,
+				Message: []byte(err.Error()),
+			})
+		}
+	}
+	return true
+}
+
+func (agent *RecvAgent) addPending() {
+	agent.pending.Add(1)
+	agent.mailed.Add(1)
+}
+
+func (agent *RecvAgent) donePending() {
+	agent.mailed.Add(-1)
+	agent.pending.Done()
+}
+
+// wait 等待放入 mailbox 的请求处理完成或者 ctx 结束
+func (agent *RecvAgent) wait(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		agent.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,227 @@
+package skynetclusterd
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMailbox(t *testing.T) {
+	// 默认每个服务使用自己的 mailbox
+	server, client := New(), New()
+	addr := listenTestCluster(t, server)
+	client.RegisterNode("server", addr)
+	defer client.Shutdown(context.Background())
+
+	release := make(chan struct{})
+	slow := NewService("slow")
+	slow.Handle("block", func(ctx context.Context, args []byte) ([]byte, error) {
+		<-release
+		return args, nil
+	})
+	var mu sync.Mutex
+	var order []int64
+	fast := NewService("fast")
+	fast.HandleMulti("echo", func(ctx context.Context, args []any) ([]any, error) {
+		return args, nil
+	})
+	fast.HandleMulti("append", func(ctx context.Context, args []any) ([]any, error) {
+		mu.Lock()
+		order = append(order, args[0].(int64))
+		mu.Unlock()
+		return nil, nil
+	})
+	var running, maxRunning atomic.Int32
+	pool := NewService("pool").SetWorkers(4)
+	pool.Handle("wait", func(ctx context.Context, args []byte) ([]byte, error) {
+		n := running.Add(1)
+		for {
+			m := maxRunning.Load()
+			if n <= m || maxRunning.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		<-release
+		running.Add(-1)
+		return args, nil
+	})
+	server.RegisterService(slow)
+	server.RegisterService(fast)
+	server.RegisterService(pool)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	// 同一个链接上 slow 阻塞时 fast 继续处理, 默认容量的 mailbox 可以放下一批请求
+	burst := make([]*Future, 200)
+	for i := range burst {
+		burst[i] = client.CallAsync(ctx, "server", "slow", "block")
+	}
+	blocked := burst[0]
+	if results, err := client.CallMulti(ctx, "server", "fast", "echo", "hi"); err != nil || results[0] != "hi" {
+		t.Fatalf("fast echo got %v %v", results, err)
+	}
+
+	// 同一个服务的请求按顺序处理
+	const n = 100
+	for i := 0; i < n; i++ {
+		client.SendMulti(ctx, "server", "fast", "append", int64(i))
+	}
+	if _, err := client.CallMulti(ctx, "server", "fast", "echo"); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	for i, v := range order {
+		if v != int64(i) {
+			t.Fatalf("order got %v", order)
+		}
+	}
+	if len(order) != n {
+		t.Errorf("append got %d want %d", len(order), n)
+	}
+	mu.Unlock()
+
+	// 多个 worker 并行处理
+	futures := make([]*Future, 4)
+	for i := range futures {
+		futures[i] = client.CallAsync(ctx, "server", "pool", "wait")
+	}
+	for running.Load() != 4 {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("workers running got %d", running.Load())
+		case <-time.After(time.Millisecond):
+		}
+	}
+	select {
+	case <-blocked.Done():
+		t.Error("slow done before release")
+	default:
+	}
+
+	close(release)
+	if err := WaitAll(ctx, append(futures, burst...)...); err != nil {
+		t.Fatal(err)
+	}
+	if maxRunning.Load() != 4 {
+		t.Errorf("max running workers got %d", maxRunning.Load())
+	}
+
+	// 移除服务后请求返回错误
+	server.UnRegisterService("fast")
+	if _, err := client.CallMulti(ctx, "server", "fast", "echo"); err == nil {
+		t.Error("call unregistered service expect error")
+	}
+	if _, err := server.Shutdown(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestMailboxFull OverloadFail 时 mailbox 满回复错误, 不阻塞同一个链接上的其他服务; handler 中可以移除自己
+func TestMailboxFull(t *testing.T) {
+	server, client := New(WithMailbox(1), WithMailboxPolicy(OverloadFail)), New()
+	addr := listenTestCluster(t, server)
+	client.RegisterNode("server", addr)
+	defer client.Shutdown(context.Background())
+	defer server.Shutdown(context.Background())
+
+	release := make(chan struct{})
+	var started atomic.Int32
+	slow := NewService("slow")
+	slow.Handle("block", func(ctx context.Context, args []byte) ([]byte, error) {
+		started.Add(1)
+		<-release
+		return args, nil
+	})
+	fast := NewService("fast")
+	fast.Handle("echo", func(ctx context.Context, args []byte) ([]byte, error) {
+		return args, nil
+	})
+	unregistered := make(chan struct{})
+	var once sync.Once
+	self := NewService("self")
+	self.Handle("quit", func(ctx context.Context, args []byte) ([]byte, error) {
+		<-release
+		server.UnRegisterService("self")
+		once.Do(func() { close(unregistered) })
+		return nil, nil
+	})
+	server.RegisterService(slow)
+	server.RegisterService(fast)
+	server.RegisterService(self)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	// 一个正在处理, 一个在 mailbox 中, 之后的请求返回错误
+	running := client.CallAsync(ctx, "server", "slow", "block")
+	for started.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	queued := client.CallAsync(ctx, "server", "slow", "block")
+	var full error
+	for full == nil {
+		_, full = client.CallMulti(ctx, "server", "slow", "block")
+		if ctx.Err() != nil {
+			t.Fatal("mailbox full expect error")
+		}
+	}
+	if !strings.Contains(full.Error(), ErrOverloaded.Error()) {
+		t.Errorf("call full mailbox got %v", full)
+	}
+	if ok, resp := client.Call(ctx, "server", "fast", "echo", "hi"); !ok || resp != "hi" {
+		t.Errorf("fast echo blocked by full mailbox got %v %s", ok, resp)
+	}
+
+	for i := 0; i < 3; i++ {
+		client.Send(ctx, "server", "self", "quit", "")
+	}
+	close(release)
+	select {
+	case <-unregistered:
+	case <-ctx.Done():
+		t.Fatal("unregister service in handler blocked")
+	}
+	if err := WaitAll(ctx, running, queued); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestMailboxBlock 默认 mailbox 满时等待空位, 请求不会返回错误
+func TestMailboxBlock(t *testing.T) {
+	server, client := New(WithMailbox(1)), New()
+	addr := listenTestCluster(t, server)
+	client.RegisterNode("server", addr)
+	defer client.Shutdown(context.Background())
+	defer server.Shutdown(context.Background())
+
+	release := make(chan struct{})
+	slow := NewService("slow")
+	slow.Handle("block", func(ctx context.Context, args []byte) ([]byte, error) {
+		<-release
+		return args, nil
+	})
+	server.RegisterService(slow)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	futures := make([]*Future, 10)
+	for i := range futures {
+		futures[i] = client.CallAsync(ctx, "server", "slow", "block")
+	}
+	time.Sleep(20 * time.Millisecond)
+	for _, f := range futures {
+		select {
+		case <-f.Done():
+			t.Fatal("call done before release")
+		default:
+		}
+	}
+	close(release)
+	if err := WaitAll(ctx, futures...); err != nil {
+		t.Fatal(err)
+	}
+}
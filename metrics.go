@@ -0,0 +1,106 @@
+package skynetclusterd
+
+import (
+	"time"
+
+	"github.com/cloudwego/netpoll"
+)
+
+const (
+	DirectionIn  = "in"
+	DirectionOut = "out"
+)
+
+type (
+	// Metrics 收集 cluster 的运行指标, 可以替换成其他监控系统的实现, 方法会被多个 goroutine 同时调用
+	// node 为空表示 Open 监听收到的链接 (对方节点发起的请求)
+	Metrics interface {
+		// CallDone Call/CallMulti/CallTyped 完成, err 为 nil 表示成功
+		CallDone(node, service, cmd string, latency time.Duration, err error)
+		// SendDone Send/SendMulti 发送完成
+		SendDone(node, service, cmd string, err error)
+		// Connect 建立到节点的链接, reconnect 表示之前已经建立过链接
+		Connect(node string, reconnect bool, err error)
+		// Bytes 链接上收发的字节数, direction 为 DirectionIn 或者 DirectionOut
+		Bytes(node, direction string, n int)
+		// Multipart 收到一个完整的 multi part 请求或者回应
+		Multipart(node string)
+		// DecodeError 解析包失败, packetType 为包的类型字节
+		DecodeError(node string, packetType byte)
+		// LateResponse 请求超时或者取消之后收到的回应, 直接丢弃
+		LateResponse(node string)
+		// Dispatched 本节点的服务处理完一个收到的请求, latency 为 handler 的耗时
+		Dispatched(service, cmd string, latency time.Duration, err error)
+	}
+
+	// SenderStats 到一个节点的链接状态
+	SenderStats struct {
+		Node        string
+		InFlight    int // 等待回应的请求数量
+		QueuedBytes int // 发送队列中还未写出的字节数
+	}
+
+	// ReceiverStats Open 监听收到的一个链接的状态
+	ReceiverStats struct {
+		Peer   string
+		Queued int // Recv 中还未处理的包数量
+	}
+
+	Stats struct {
+		Senders   []SenderStats
+		Receivers []ReceiverStats
+	}
+
+	noopMetrics struct{}
+
+	// metricsBinder Metrics 实现这个接口时 New 会把 Cluster 传给它, 用于读取 Stats, Shutdown 时移除
+	metricsBinder interface {
+		bind(c *Cluster)
+		unbind(c *Cluster)
+	}
+)
+
+func (noopMetrics) CallDone(node, service, cmd string, latency time.Duration, err error) {}
+func (noopMetrics) SendDone(node, service, cmd string, err error)                        {}
+func (noopMetrics) Connect(node string, reconnect bool, err error)                       {}
+func (noopMetrics) Bytes(node, direction string, n int)                                  {}
+func (noopMetrics) Multipart(node string)                                                {}
+func (noopMetrics) DecodeError(node string, packetType byte)                             {}
+func (noopMetrics) LateResponse(node string)                                             {}
+func (noopMetrics) Dispatched(service, cmd string, latency time.Duration, err error)     {}
+
+// WithMetrics 设置指标收集的实现, 默认不收集
+func WithMetrics(m Metrics) Option {
+	return func(c *Cluster) {
+		c.metrics = m
+	}
+}
+
+// Stats 当前所有链接的状态, 用于输出 gauge 类型的指标
+func (c *Cluster) Stats() Stats {
+	var stats Stats
+	c.senders.Lock.RLock()
+	for agent := range c.senders.agents {
+		stats.Senders = append(stats.Senders, SenderStats{
+			Node:        agent.Name,
+			InFlight:    agent.InFlight(),
+			QueuedBytes: agent.QueuedBytes(),
+		})
+	}
+	c.senders.Lock.RUnlock()
+
+	c.mu.Lock()
+	for agent := range c.receivers {
+		stats.Receivers = append(stats.Receivers, ReceiverStats{
+			Peer:   agent.conn.RemoteAddr().String(),
+			Queued: len(agent.Recv),
+		})
+	}
+	c.mu.Unlock()
+	return stats
+}
+
+// bufferSize 编码到 LinkBuffer 中的字节数, 包括已经 Flush 和还未 Flush 的部分
+func bufferSize(buf *netpoll.LinkBuffer) int {
+	return buf.Len() + buf.MallocLen()
+}
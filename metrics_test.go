@@ -0,0 +1,109 @@
+package skynetclusterd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/changlongH/skynet_cluster/codec"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	serverMetrics, clientMetrics := NewPrometheusMetrics(nil), NewPrometheusMetrics(nil)
+	server, client := New(WithMetrics(serverMetrics)), New(WithMetrics(clientMetrics))
+	addr := listenTestCluster(t, server)
+	client.RegisterNode("server", addr)
+	defer server.Shutdown(context.Background())
+	defer client.Shutdown(context.Background())
+
+	release := make(chan struct{})
+	svc := NewService("metrics")
+	svc.Handle("echo", func(ctx context.Context, args []byte) ([]byte, error) {
+		return args, nil
+	})
+	svc.Handle("fail", func(ctx context.Context, args []byte) ([]byte, error) {
+		return nil, errors.New("fail")
+	})
+	svc.Handle("block", func(ctx context.Context, args []byte) ([]byte, error) {
+		<-release
+		return nil, nil
+	})
+	server.RegisterService(svc)
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	large := strings.Repeat("x", int(codec.PartSize)*2)
+	if ok, resp := client.Call(ctx, "server", "metrics", "echo", large); !ok || resp != large {
+		t.Fatalf("call echo got %v", ok)
+	}
+	client.Call(ctx, "server", "metrics", "fail", "")
+	client.Send(ctx, "server", "metrics", "echo", "")
+
+	short, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	client.Call(short, "server", "metrics", "block", "")
+
+	// 等待中的 block 请求, 非法的请求包
+	go client.Call(ctx, "server", "metrics", "block", "")
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte{0, 1, 0x99})
+	defer conn.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	var b strings.Builder
+	clientMetrics.WriteTo(&b)
+	clientText := b.String()
+	for _, line := range []string{
+		`skynet_cluster_calls_total{node="server",service="metrics",cmd="echo",result="ok"} 1`,
+		`skynet_cluster_calls_total{node="server",service="metrics",cmd="fail",result="remote_error"} 1`,
+		`skynet_cluster_calls_total{node="server",service="metrics",cmd="block",result="timeout"} 1`,
+		`skynet_cluster_sends_total{node="server",service="metrics",cmd="echo",result="ok"} 1`,
+		`skynet_cluster_call_duration_seconds_count{node="server",service="metrics",cmd="echo"} 1`,
+		`skynet_cluster_call_duration_seconds_bucket{node="server",service="metrics",cmd="echo",le="+Inf"} 1`,
+		`skynet_cluster_connects_total{node="server",result="ok"} 1`,
+		`skynet_cluster_multipart_total{node="server"} 1`,
+		`skynet_cluster_inflight_sessions{node="server"} 1`,
+		"# TYPE skynet_cluster_call_duration_seconds histogram",
+	} {
+		if !strings.Contains(clientText, line+"\n") {
+			t.Errorf("client metrics missing %s\n%s", line, clientText)
+		}
+	}
+	if !strings.Contains(clientText, `skynet_cluster_bytes_total{node="server",direction="out"} `) {
+		t.Errorf("client metrics missing bytes out")
+	}
+
+	b.Reset()
+	serverMetrics.WriteTo(&b)
+	serverText := b.String()
+	for _, line := range []string{
+		`skynet_cluster_multipart_total{node=""} 1`,
+		`skynet_cluster_decode_errors_total{node="",type="0x99"} 1`,
+		`skynet_cluster_dispatched_total{service="metrics",cmd="echo",result="ok"} 2`,
+		`skynet_cluster_dispatched_total{service="metrics",cmd="fail",result="error"} 1`,
+		`skynet_cluster_dispatch_duration_seconds_count{service="metrics",cmd="echo"} 2`,
+		"# TYPE skynet_cluster_recv_queue_depth gauge",
+	} {
+		if !strings.Contains(serverText, line+"\n") {
+			t.Errorf("server metrics missing %s\n%s", line, serverText)
+		}
+	}
+
+	// Shutdown 之后不再输出这个 Cluster 的状态
+	closed := New(WithMetrics(serverMetrics))
+	closed.Shutdown(context.Background())
+	serverMetrics.Lock()
+	bound := len(serverMetrics.clusters)
+	serverMetrics.Unlock()
+	if bound != 1 {
+		t.Errorf("metrics bound %d clusters after shutdown want 1", bound)
+	}
+}
@@ -0,0 +1,84 @@
+package skynetclusterd
+
+import (
+	"time"
+
+	"github.com/changlongH/skynet_cluster/codec"
+)
+
+const (
+	defaultPartialTimeout = time.Minute
+)
+
+// WithMaxMessageSize 收到的 multi part 请求和回应的最大字节数, 默认不限制
+// 超过时请求直接回复错误, 回应返回给调用方错误, 不会按对方声明的大小分配内存
+func WithMaxMessageSize(n int) Option {
+	return func(c *Cluster) {
+		c.limits.MaxSize = n
+	}
+}
+
+// WithMaxPartial 每个链接上同时接收的 multi part 消息数量, 超过时同 WithMaxMessageSize, 默认不限制
+func WithMaxPartial(n int) Option {
+	return func(c *Cluster) {
+		c.limits.MaxPartial = n
+	}
+}
+
+// WithPartialTimeout multi part 消息从收到开始到收完的最长时间, 超时后丢弃并返回错误
+// 默认 1 分钟, 0 不检查
+func WithPartialTimeout(d time.Duration) Option {
+	return func(c *Cluster) {
+		c.partialTimeout = d
+	}
+}
+
+// newSweeper 定时检查超时的 multi part 消息, 没有设置 WithPartialTimeout 时返回 nil
+func (c *Cluster) newSweeper() *time.Ticker {
+	if c.partialTimeout <= 0 {
+		return nil
+	}
+	return time.NewTicker(max(c.partialTimeout/2, time.Millisecond))
+}
+
+// sweepC ticker 为 nil 时返回 nil channel, select 时不会触发
+func sweepC(ticker *time.Ticker) <-chan time.Time {
+	if ticker == nil {
+		return nil
+	}
+	return ticker.C
+}
+
+// expire 丢弃超时的 multi part 请求并回复错误
+func (agent *RecvAgent) expire(now time.Time) {
+	for _, req := range codec.ExpireLargeReq(agent.LargeRequest, now.Add(-agent.c.partialTimeout)) {
+		agent.logger.Warn("drop expired multi part request", "service", serviceName(req.Addr), "session", req.Session)
+		agent.Response(&codec.RespPack{
+			Session: req.Session,
+			Ok:      false,
+			Message: []byte(codec.ErrPartialExpired.Error()),
+		})
+	}
+}
+
+// expire 丢弃超时的 multi part 回应, 等待的请求返回错误
+func (agent *SenderAgent) expire(now time.Time) {
+	before := now.Add(-agent.mgr.c.partialTimeout)
+	for session, at := range agent.discarded {
+		if at.Before(before) {
+			delete(agent.discarded, session)
+		}
+	}
+	for _, session := range codec.ExpireLargeResp(agent.LargeResponse, before) {
+		agent.logger.Warn("drop expired multi part response", "session", session)
+		agent.reject(session, codec.ErrPartialExpired)
+	}
+}
+
+// reject 超过限制或者超时的回应不再接收, 后续的部分直接丢弃
+func (agent *SenderAgent) reject(session uint32, err error) {
+	agent.discarded[session] = time.Now()
+	if req, ok := agent.sessions.remove(session); ok {
+		req.fail(err)
+	}
+}
@@ -0,0 +1,98 @@
+package skynetclusterd
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/changlongH/skynet_cluster/codec"
+	"github.com/cloudwego/netpoll"
+)
+
+func TestMultipartLimits(t *testing.T) {
+	server := New(WithMaxMessageSize(int(codec.PartSize) * 2))
+	svc := NewService("echo")
+	svc.HandleMulti("echo", func(ctx context.Context, args []any) ([]any, error) {
+		return args, nil
+	})
+	svc.HandleMulti("repeat", func(ctx context.Context, args []any) ([]any, error) {
+		return []any{strings.Repeat("x", int(args[0].(int64)))}, nil
+	})
+	server.RegisterService(svc)
+	addr := listenTestCluster(t, server)
+	defer server.Shutdown(context.Background())
+	client := New(WithMaxMessageSize(int(codec.PartSize) * 3))
+	client.RegisterNode("server", addr)
+	defer client.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	// 超过对方限制的请求返回错误, 不影响链接上的其他请求
+	large := strings.Repeat("x", int(codec.PartSize)*4)
+	var remote *RemoteError
+	if _, err := client.CallMulti(ctx, "server", "echo", "echo", large); !errors.As(err, &remote) ||
+		!strings.Contains(remote.Message, codec.ErrMessageTooLarge.Error()) {
+		t.Fatalf("call too large request got %v", err)
+	}
+	medium := strings.Repeat("x", int(codec.PartSize)+1)
+	if results, err := client.CallMulti(ctx, "server", "echo", "echo", medium); err != nil || results[0] != medium {
+		t.Fatalf("call multi part request got %v", err)
+	}
+
+	// 超过自己限制的回应返回错误
+	if _, err := client.CallMulti(ctx, "server", "echo", "repeat", int(codec.PartSize)*4); !errors.Is(err, codec.ErrMessageTooLarge) {
+		t.Fatalf("call too large response got %v", err)
+	}
+	if results, err := client.CallMulti(ctx, "server", "echo", "repeat", 3); err != nil || results[0] != "xxx" {
+		t.Fatalf("call after too large response got %v %v", results, err)
+	}
+}
+
+// TestPartialTimeout 最后一部分一直没有收到的请求超时后回复错误
+func TestPartialTimeout(t *testing.T) {
+	server := New(WithPartialTimeout(time.Millisecond * 100))
+	addr := listenTestCluster(t, server)
+	defer server.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := netpoll.NewLinkBuffer()
+	req := &codec.ReqPack{
+		Addr:    codec.Addr{Name: "echo"},
+		Session: 7,
+		Cmd:     "echo",
+		Args:    []any{strings.Repeat("x", int(codec.PartSize)*2)},
+	}
+	if err := codec.EncodeReq(buf, req); err != nil {
+		t.Fatal(err)
+	}
+	buf.Flush()
+	data, _ := buf.Next(buf.Len())
+	conn.Write(data[:len(data)/2])
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * 3))
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header))
+	if _, err := io.ReadFull(conn, body); err != nil {
+		t.Fatal(err)
+	}
+	pkg := netpoll.NewLinkBuffer()
+	pkg.WriteBinary(body)
+	pkg.Flush()
+	resp, err := codec.DecodeResp(pkg, nil)
+	if err != nil || resp.Session != 7 || resp.Ok || string(resp.Message) != codec.ErrPartialExpired.Error() {
+		t.Fatalf("expired response got %+v %v", resp, err)
+	}
+}
@@ -0,0 +1,149 @@
+package skynetclusterd
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/changlongH/skynet_cluster/codec"
+)
+
+// PoolPolicy 节点有多个链接时选择链接的方式
+type PoolPolicy int
+
+const (
+	// PoolRoundRobin 按顺序轮流使用每个链接
+	PoolRoundRobin PoolPolicy = iota
+	// PoolLeastInFlight 使用等待回应的请求最少的链接
+	PoolLeastInFlight
+)
+
+const (
+	// largeSlot 大包专用链接的位置
+	largeSlot = -1
+	// noSlot 还没有选择链接
+	noSlot = -2
+)
+
+type (
+	// nodePool 到一个节点的所有链接, conns 中为 nil 的位置还没有建立链接
+	nodePool struct {
+		conns []*SenderAgent
+		large *SenderAgent
+		next  atomic.Uint32
+	}
+
+	largekey struct{}
+)
+
+// WithPool 每个节点建立 size 个链接, 按 policy 选择链接, 默认每个节点一个链接
+// 链接在使用时才建立, 同一个节点同时只建立一个链接
+func WithPool(size int, policy PoolPolicy) Option {
+	return func(c *Cluster) {
+		c.poolSize = max(size, 1)
+		c.poolPolicy = policy
+	}
+}
+
+// WithLargeConn 每个节点额外建立一个链接, 专门发送 multi part 请求和 WithLargePayload 标记的请求
+// 避免大包阻塞其他请求
+func WithLargeConn() Option {
+	return func(c *Cluster) {
+		c.largeConn = true
+	}
+}
+
+// WithLargePayload 标记请求的回应是大包, 开启 WithLargeConn 时使用大包专用的链接
+func WithLargePayload(ctx context.Context) context.Context {
+	return context.WithValue(ctx, largekey{}, true)
+}
+
+func newNodePool(size int) *nodePool {
+	return &nodePool{
+		conns: make([]*SenderAgent, size),
+	}
+}
+
+// pick 按 policy 选择一个链接, 返回 nil 时需要在 slot 位置建立链接
+func (p *nodePool) pick(policy PoolPolicy, large bool) (*SenderAgent, int) {
+	if large {
+		return p.large, largeSlot
+	}
+	switch policy {
+	case PoolLeastInFlight:
+		var best *SenderAgent
+		for i, agent := range p.conns {
+			if agent == nil {
+				return nil, i
+			}
+			if best == nil || agent.InFlight() < best.InFlight() {
+				best = agent
+			}
+		}
+		return best, 0
+	default:
+		i := int(p.next.Add(1)-1) % len(p.conns)
+		return p.conns[i], i
+	}
+}
+
+// any 返回任意一个已经建立的链接, 正在建立其他链接时使用
+func (p *nodePool) any() *SenderAgent {
+	for _, agent := range p.conns {
+		if agent != nil {
+			return agent
+		}
+	}
+	return nil
+}
+
+func (p *nodePool) get(slot int) *SenderAgent {
+	if slot == largeSlot {
+		return p.large
+	}
+	return p.conns[slot]
+}
+
+func (p *nodePool) set(slot int, agent *SenderAgent) {
+	if slot == largeSlot {
+		p.large = agent
+	} else {
+		p.conns[slot] = agent
+	}
+}
+
+// remove 链接断开时空出位置, 下次选中时重新建立链接
+func (p *nodePool) remove(agent *SenderAgent) {
+	if p.large == agent {
+		p.large = nil
+	}
+	for i, a := range p.conns {
+		if a == agent {
+			p.conns[i] = nil
+		}
+	}
+}
+
+// all 所有已经建立的链接
+func (p *nodePool) all() []*SenderAgent {
+	agents := make([]*SenderAgent, 0, len(p.conns)+1)
+	for _, agent := range p.conns {
+		if agent != nil {
+			agents = append(agents, agent)
+		}
+	}
+	if p.large != nil {
+		agents = append(agents, p.large)
+	}
+	return agents
+}
+
+// isLarge 请求是否使用大包专用的链接, pack 需要已经打包
+func (c *Cluster) isLarge(ctx context.Context, pack *codec.ReqPack) bool {
+	if !c.largeConn {
+		return false
+	}
+	if large, _ := ctx.Value(largekey{}).(bool); large {
+		return true
+	}
+	return pack.Multipart()
+}
@@ -0,0 +1,104 @@
+package skynetclusterd
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/changlongH/skynet_cluster/codec"
+)
+
+// startPoolServer 启动一个有 echo 和 block 命令的节点, release 关闭前 block 不返回
+func startPoolServer(t *testing.T, release chan struct{}) (*Cluster, string) {
+	t.Helper()
+	server := New()
+	svc := NewService("pool")
+	svc.Handle("echo", func(ctx context.Context, args []byte) ([]byte, error) {
+		return args, nil
+	})
+	svc.Handle("block", func(ctx context.Context, args []byte) ([]byte, error) {
+		<-release
+		return args, nil
+	})
+	server.RegisterService(svc)
+	return server, listenTestCluster(t, server)
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	release := make(chan struct{})
+	server, addr := startPoolServer(t, release)
+	defer server.Shutdown(context.Background())
+	defer close(release)
+	client := New(WithPool(3, PoolRoundRobin), WithLargeConn())
+	client.RegisterNode("server", addr)
+	defer client.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	for i := 0; i < 6; i++ {
+		if ok, resp := client.Call(ctx, "server", "pool", "echo", "hello"); !ok || resp != "hello" {
+			t.Fatalf("call echo got %v %s", ok, resp)
+		}
+	}
+	if n := len(client.Stats().Senders); n != 3 {
+		t.Errorf("senders got %d want 3", n)
+	}
+
+	// multi part 请求使用大包专用的链接
+	large := strings.Repeat("x", int(codec.PartSize)*2)
+	if ok, resp := client.Call(ctx, "server", "pool", "echo", large); !ok || resp != large {
+		t.Fatalf("call large got %v", ok)
+	}
+	if n := len(client.Stats().Senders); n != 4 {
+		t.Errorf("senders with large conn got %d want 4", n)
+	}
+
+	// 标记为大包的请求阻塞时不影响其他链接
+	go client.Call(WithLargePayload(ctx), "server", "pool", "block", "")
+	client.senders.Lock.RLock()
+	largeAgent := client.senders.pools["server"].large
+	client.senders.Lock.RUnlock()
+	for largeAgent.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 3; i++ {
+		if ok, _ := client.Call(ctx, "server", "pool", "echo", "hello"); !ok {
+			t.Fatal("call echo blocked by large conn")
+		}
+	}
+}
+
+func TestPoolLeastInFlight(t *testing.T) {
+	release := make(chan struct{})
+	server, addr := startPoolServer(t, release)
+	defer server.Shutdown(context.Background())
+	defer close(release)
+	client := New(WithPool(2, PoolLeastInFlight))
+	client.RegisterNode("server", addr)
+	defer client.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	blocked := client.CallAsync(ctx, "server", "pool", "block")
+	for len(client.Stats().Senders) == 0 || client.Stats().Senders[0].InFlight == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// 其余的请求都使用另一个空闲的链接
+	for i := 0; i < 5; i++ {
+		if ok, _ := client.Call(ctx, "server", "pool", "echo", "hello"); !ok {
+			t.Fatal("call echo blocked")
+		}
+	}
+	stats := client.Stats()
+	if len(stats.Senders) != 2 {
+		t.Errorf("senders got %d want 2", len(stats.Senders))
+	}
+	select {
+	case <-blocked.Done():
+		t.Error("block call done before release")
+	default:
+	}
+}
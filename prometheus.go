@@ -0,0 +1,316 @@
+package skynetclusterd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const metricsPrefix = "skynet_cluster_"
+
+var (
+	// DefaultLatencyBuckets Call 和 handler 耗时的 histogram 区间, 单位秒
+	DefaultLatencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+)
+
+type (
+	// PrometheusMetrics 内置的 Metrics 实现, 按 prometheus text format 输出, 不依赖 prometheus client
+	//
+	//	m := NewPrometheusMetrics(nil)
+	//	c := New(WithMetrics(m))
+	//	http.Handle("/metrics", m)
+	PrometheusMetrics struct {
+		sync.Mutex
+		buckets  []float64
+		clusters []*Cluster
+
+		calls        map[string]*histogram // {node,service,cmd}
+		callResults  map[string]uint64     // {node,service,cmd,result}
+		dispatches   map[string]*histogram // {service,cmd}
+		dispatched   map[string]uint64     // {service,cmd,result}
+		sends        map[string]uint64     // {node,service,cmd,result}
+		connects     map[string]uint64     // {node,result}
+		reconnects   map[string]uint64     // {node}
+		bytes        map[string]uint64     // {node,direction}
+		multiparts   map[string]uint64     // {node}
+		decodeErrors map[string]uint64     // {node,type}
+		lateResps    map[string]uint64     // {node}
+	}
+
+	histogram struct {
+		counts []uint64 // 每个区间的数量, 输出时累加
+		count  uint64
+		sum    float64
+	}
+
+	// series 一条指标, labels 为 {k="v",...} 格式
+	series struct {
+		labels string
+		value  string
+	}
+)
+
+// NewPrometheusMetrics buckets 为 nil 时使用 DefaultLatencyBuckets
+func NewPrometheusMetrics(buckets []float64) *PrometheusMetrics {
+	if buckets == nil {
+		buckets = DefaultLatencyBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &PrometheusMetrics{
+		buckets:      buckets,
+		calls:        make(map[string]*histogram),
+		callResults:  make(map[string]uint64),
+		dispatches:   make(map[string]*histogram),
+		dispatched:   make(map[string]uint64),
+		sends:        make(map[string]uint64),
+		connects:     make(map[string]uint64),
+		reconnects:   make(map[string]uint64),
+		bytes:        make(map[string]uint64),
+		multiparts:   make(map[string]uint64),
+		decodeErrors: make(map[string]uint64),
+		lateResps:    make(map[string]uint64),
+	}
+}
+
+func (m *PrometheusMetrics) bind(c *Cluster) {
+	m.Lock()
+	defer m.Unlock()
+	m.clusters = append(m.clusters, c)
+}
+
+func (m *PrometheusMetrics) unbind(c *Cluster) {
+	m.Lock()
+	defer m.Unlock()
+	for i, bound := range m.clusters {
+		if bound == c {
+			m.clusters = append(m.clusters[:i], m.clusters[i+1:]...)
+			return
+		}
+	}
+}
+
+// resultLabel 请求结果: ok, timeout, remote_error (远端返回错误) 或者 error
+func resultLabel(err error) string {
+	var remoteErr *RemoteError
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, ErrTimeout):
+		return "timeout"
+	case errors.As(err, &remoteErr):
+		return "remote_error"
+	default:
+		return "error"
+	}
+}
+
+func (m *PrometheusMetrics) CallDone(node, service, cmd string, latency time.Duration, err error) {
+	key := labels("node", node, "service", service, "cmd", cmd)
+	resultKey := labels("node", node, "service", service, "cmd", cmd, "result", resultLabel(err))
+
+	m.Lock()
+	defer m.Unlock()
+	m.callResults[resultKey]++
+	m.observe(m.calls, key, latency)
+}
+
+func (m *PrometheusMetrics) Dispatched(service, cmd string, latency time.Duration, err error) {
+	key := labels("service", service, "cmd", cmd)
+	resultKey := labels("service", service, "cmd", cmd, "result", resultLabel(err))
+
+	m.Lock()
+	defer m.Unlock()
+	m.dispatched[resultKey]++
+	m.observe(m.dispatches, key, latency)
+}
+
+// observe 记录一次耗时, 需要持有锁
+func (m *PrometheusMetrics) observe(hists map[string]*histogram, key string, latency time.Duration) {
+	h, ok := hists[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(m.buckets))}
+		hists[key] = h
+	}
+	seconds := latency.Seconds()
+	if i := sort.SearchFloat64s(m.buckets, seconds); i < len(m.buckets) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += seconds
+}
+
+func (m *PrometheusMetrics) SendDone(node, service, cmd string, err error) {
+	key := labels("node", node, "service", service, "cmd", cmd, "result", resultLabel(err))
+	m.Lock()
+	defer m.Unlock()
+	m.sends[key]++
+}
+
+func (m *PrometheusMetrics) Connect(node string, reconnect bool, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	key := labels("node", node, "result", result)
+	m.Lock()
+	defer m.Unlock()
+	m.connects[key]++
+	if reconnect && err == nil {
+		m.reconnects[labels("node", node)]++
+	}
+}
+
+func (m *PrometheusMetrics) Bytes(node, direction string, n int) {
+	key := labels("node", node, "direction", direction)
+	m.Lock()
+	defer m.Unlock()
+	m.bytes[key] += uint64(n)
+}
+
+func (m *PrometheusMetrics) Multipart(node string) {
+	key := labels("node", node)
+	m.Lock()
+	defer m.Unlock()
+	m.multiparts[key]++
+}
+
+func (m *PrometheusMetrics) DecodeError(node string, packetType byte) {
+	key := labels("node", node, "type", fmt.Sprintf("0x%02x", packetType))
+	m.Lock()
+	defer m.Unlock()
+	m.decodeErrors[key]++
+}
+
+func (m *PrometheusMetrics) LateResponse(node string) {
+	key := labels("node", node)
+	m.Lock()
+	defer m.Unlock()
+	m.lateResps[key]++
+}
+
+// WriteTo 按 prometheus text format 输出所有指标
+func (m *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+
+	m.Lock()
+	m.writeHistogram(&b, "call_duration_seconds", "Latency of Call requests.", m.calls)
+	writeCounters(&b, "calls_total", "Call requests by result (ok, timeout, remote_error, error).", m.callResults)
+	m.writeHistogram(&b, "dispatch_duration_seconds", "Latency of handlers serving requests received by this node.", m.dispatches)
+	writeCounters(&b, "dispatched_total", "Requests received by this node by service, cmd and result.", m.dispatched)
+	writeCounters(&b, "sends_total", "Send requests by result.", m.sends)
+	writeCounters(&b, "connects_total", "Connections dialed to nodes by result.", m.connects)
+	writeCounters(&b, "reconnects_total", "Connections re-established to nodes after a previous connection.", m.reconnects)
+	writeCounters(&b, "bytes_total", "Bytes read and written, node is empty for accepted connections.", m.bytes)
+	writeCounters(&b, "multipart_total", "Multipart requests and responses reassembled.", m.multiparts)
+	writeCounters(&b, "decode_errors_total", "Packets failed to decode by packet type.", m.decodeErrors)
+	writeCounters(&b, "late_responses_total", "Responses dropped because the call was cancelled or timed out.", m.lateResps)
+	clusters := append([]*Cluster(nil), m.clusters...)
+	m.Unlock()
+
+	var inflight, sendQueued, queued []series
+	for _, c := range clusters {
+		stats := c.Stats()
+		perNode := make(map[string]int)
+		perNodeBytes := make(map[string]int)
+		for _, s := range stats.Senders {
+			perNode[s.Node] += s.InFlight
+			perNodeBytes[s.Node] += s.QueuedBytes
+		}
+		for node, n := range perNode {
+			inflight = append(inflight, series{labels("node", node), strconv.Itoa(n)})
+			sendQueued = append(sendQueued, series{labels("node", node), strconv.Itoa(perNodeBytes[node])})
+		}
+		for _, r := range stats.Receivers {
+			queued = append(queued, series{labels("peer", r.Peer), strconv.Itoa(r.Queued)})
+		}
+	}
+	writeFamily(&b, "inflight_sessions", "Requests waiting for response per node.", "gauge", inflight)
+	writeFamily(&b, "send_queue_bytes", "Request bytes queued but not yet written per node.", "gauge", sendQueued)
+	writeFamily(&b, "recv_queue_depth", "Packets queued in RecvAgent.Recv per accepted connection.", "gauge", queued)
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+func (m *PrometheusMetrics) writeHistogram(b *strings.Builder, name, help string, hists map[string]*histogram) {
+	if len(hists) == 0 {
+		return
+	}
+	name = metricsPrefix + name
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	keys := make([]string, 0, len(hists))
+	for key := range hists {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		h := hists[key]
+		// key 为 {...}, 去掉结尾的 } 后追加 le
+		prefix := key[:len(key)-1] + ","
+		cumulative := uint64(0)
+		for i, le := range m.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(b, "%s_bucket%sle=\"%s\"} %d\n", name, prefix, formatFloat(le), cumulative)
+		}
+		fmt.Fprintf(b, "%s_bucket%sle=\"+Inf\"} %d\n", name, prefix, h.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", name, key, formatFloat(h.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", name, key, h.count)
+	}
+}
+
+func writeCounters(b *strings.Builder, name, help string, values map[string]uint64) {
+	ss := make([]series, 0, len(values))
+	for key, v := range values {
+		ss = append(ss, series{key, strconv.FormatUint(v, 10)})
+	}
+	writeFamily(b, name, help, "counter", ss)
+}
+
+func writeFamily(b *strings.Builder, name, help, typ string, ss []series) {
+	if len(ss) == 0 {
+		return
+	}
+	name = metricsPrefix + name
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	sort.Slice(ss, func(i, j int) bool {
+		return ss[i].labels < ss[j].labels
+	})
+	for _, s := range ss {
+		fmt.Fprintf(b, "%s%s %s\n", name, s.labels, s.value)
+	}
+}
+
+// labels 把 k1, v1, k2, v2... 格式化为 {k1="v1",k2="v2"}
+func labels(kv ...string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(kv); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(kv[i])
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(kv[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -13,24 +13,34 @@ const (
 	headerSize = 2
 )
 
-var _ netpoll.OnPrepare = prepare
+var _ netpoll.OnPrepare = (*Cluster)(nil).prepare
 var _ netpoll.OnConnect = connect
 var _ netpoll.OnRequest = handle
 
 type connkey struct{}
 
-var ctxkey connkey
-
-func prepare(conn netpoll.Connection) context.Context {
-	agent := NewRecvAgent(conn)
-	ctx := context.WithValue(context.Background(), ctxkey, agent)
+func (c *Cluster) prepare(conn netpoll.Connection) context.Context {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		// Shutdown 之后不再接受新的链接
+		c.log().Info("reject connection after shutdown", "remote_addr", conn.RemoteAddr().String())
+		conn.Close()
+		return context.Background()
+	}
+	agent := c.newRecvAgent(conn)
+	ctx := context.WithValue(context.Background(), connkey{}, agent)
 	return ctx
 }
 
 func connect(ctx context.Context, conn netpoll.Connection) context.Context {
-	agent := ctx.Value(ctxkey).(*RecvAgent)
+	agent, _ := ctx.Value(connkey{}).(*RecvAgent)
+	if agent == nil {
+		return ctx
+	}
 	conn.AddCloseCallback(func(conn netpoll.Connection) error {
-		agent.CloseCh <- struct{}{}
+		agent.Close()
 		return nil
 	})
 	return ctx
@@ -48,18 +58,24 @@ func handle(ctx context.Context, conn netpoll.Connection) error {
 		return err
 	}
 
-	agent := ctx.Value(ctxkey).(*RecvAgent)
+	agent, _ := ctx.Value(connkey{}).(*RecvAgent)
 	if agent == nil {
 		addr := conn.RemoteAddr().String()
 		return errors.New("invalid conn node agent" + addr)
 	}
 
 	//msg, err = codec.DecodeReq(pkg, agent.LargeRequest)
-	agent.Recv <- pkg
-	return nil
+	agent.c.metrics.Bytes("", DirectionIn, pkgsize+headerSize)
+	select {
+	case agent.Recv <- pkg:
+		return nil
+	case <-agent.done:
+		return ErrConnClosed
+	}
 }
 
-func Open(address string) (netpoll.EventLoop, error) {
+// Open 监听 address 并处理其他节点的请求, 阻塞到监听关闭
+func (c *Cluster) Open(address string) (netpoll.EventLoop, error) {
 	listener, err := netpoll.CreateListener("tcp", address)
 	if err != nil {
 		return nil, err
@@ -67,20 +83,43 @@ func Open(address string) (netpoll.EventLoop, error) {
 
 	eventLoop, err := netpoll.NewEventLoop(
 		handle,
-		netpoll.WithOnPrepare(prepare),
+		netpoll.WithOnPrepare(c.prepare),
 		netpoll.WithOnConnect(connect),
-		netpoll.WithReadTimeout(time.Second),
+		netpoll.WithReadTimeout(c.readTimeout),
 	)
 	if err != nil {
+		listener.Close()
 		return nil, err
 	}
 
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		listener.Close()
+		return nil, ErrShutdown
+	}
+	c.listener = listener
+	c.eventLoop = eventLoop
+	c.mu.Unlock()
+
 	err = eventLoop.Serve(listener)
 	return eventLoop, err
 }
 
-func Shutdown(eventLoop netpoll.EventLoop, timeout time.Duration) {
+func Open(address string) (netpoll.EventLoop, error) {
+	return defaultCluster.Open(address)
+}
+
+// Shutdown 关闭 Open 返回的 eventLoop
+// 默认 Cluster 的 eventLoop 会等待请求处理完成后关闭, 见 Cluster.Shutdown
+func Shutdown(eventLoop netpoll.EventLoop, timeout time.Duration) (ShutdownReport, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
-	eventLoop.Shutdown(ctx)
+	defaultCluster.mu.Lock()
+	owned := defaultCluster.eventLoop == eventLoop
+	defaultCluster.mu.Unlock()
+	if owned {
+		return defaultCluster.Shutdown(ctx)
+	}
+	return ShutdownReport{}, eventLoop.Shutdown(ctx)
 }
@@ -3,64 +3,107 @@ package skynetclusterd
 import (
 	"context"
 	"encoding/binary"
-	"fmt"
+	"errors"
+	"log/slog"
+	"runtime/debug"
 	"sync"
 	"time"
 
 	"github.com/changlongH/skynet_cluster/codec"
 	"github.com/cloudwego/netpoll"
 	"github.com/cloudwego/netpoll/mux"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type (
 	Request struct {
-		RespCh chan *codec.RespPack
+		RespCh chan *codec.RespPack // 缓冲为 1, 回应时不会阻塞
+		err    error                // 本地错误, 设置后关闭 RespCh
+
+		// callback 非 nil 时回应和错误不写入 RespCh, 直接在 WaitResponse 的 goroutine 中调用
+		callback func(msg *codec.RespPack, err error)
 	}
 
 	SenderAgent struct {
-		Name    string
-		conn    netpoll.Connection
-		wqueue  *mux.ShardQueue // use for write
-		CloseCh chan struct{}
+		mgr       *SenderMgr
+		logger    *slog.Logger
+		Name      string
+		conn      netpoll.Connection
+		wqueue    *mux.ShardQueue // use for write
+		CloseCh   chan struct{}
+		closeOnce sync.Once
+		closeErr  error // 关闭时等待中的请求返回的错误
 
 		Recv          chan netpoll.Reader
 		LargeResponse map[uint32]*codec.RespPack
+		cancelCh      chan uint32          // 取消的 session, WaitResponse 释放未收完的回应
+		discarded     map[uint32]time.Time // 已经取消或者失败, 还在接收的 multi part 回应, 值为丢弃的时间
+
+		sessions *sessionTable
+		limiter  *limiter
+		deadline bool // 对方支持 deadline, 建立链接时握手
+
+		queueMu     sync.Mutex
+		queued      int  // 发送队列中还未写出的字节数
+		queueClosed bool // 链接关闭后不再统计
+	}
 
-		IncSession  uint32
-		ReqSessions map[uint32]*Request
+	// nodeDialer 节点建立链接的状态, 连续失败时指数退避
+	// 退避时间内的请求直接返回上次的错误, 不再等待
+	nodeDialer struct {
+		done     chan struct{} // 正在建立链接时非 nil, 完成后关闭
+		failures int
+		retryAt  time.Time
+		addr     string // 上次失败的地址, 节点地址变化后立即重新建立链接
+		err      error  // 上次失败的错误
 	}
 
 	SenderMgr struct {
+		c         *Cluster
 		Lock      sync.RWMutex
-		NodeAgent map[string]*SenderAgent
+		pools     map[string]*nodePool
+		dialers   map[string]*nodeDialer
+		agents    map[*SenderAgent]struct{} // 包括已经从 pools 移除但还未关闭的链接
+		connected map[string]bool           // 建立过链接的节点, 用于统计重连
+		limiters  map[string]*limiter
+		closed    bool
 	}
 )
 
-var (
-	senderMgr *SenderMgr
-	_once     sync.Once
+const (
+	drainInterval = time.Millisecond * 10
 )
 
-func getSenderMgr() *SenderMgr {
-	_once.Do(func() {
-		senderMgr = &SenderMgr{
-			NodeAgent: map[string]*SenderAgent{},
-		}
-	})
-	return senderMgr
+func newSenderMgr(c *Cluster) *SenderMgr {
+	return &SenderMgr{
+		c:         c,
+		pools:     map[string]*nodePool{},
+		dialers:   map[string]*nodeDialer{},
+		agents:    map[*SenderAgent]struct{}{},
+		connected: map[string]bool{},
+		limiters:  map[string]*limiter{},
+	}
 }
 
-func NewSenderAgent(nodeName string, conn netpoll.Connection) *SenderAgent {
+func (mgr *SenderMgr) newSenderAgent(nodeName string, conn netpoll.Connection) *SenderAgent {
 	agent := &SenderAgent{
+		mgr:           mgr,
+		logger:        mgr.c.log().With("node", nodeName, "remote_addr", conn.RemoteAddr().String()),
 		Name:          nodeName,
 		conn:          conn,
 		wqueue:        mux.NewShardQueue(mux.ShardSize, conn),
 		Recv:          make(chan netpoll.Reader, 1000),
 		CloseCh:       make(chan struct{}),
 		LargeResponse: make(map[uint32]*codec.RespPack),
-		IncSession:    1,
-		ReqSessions:   make(map[uint32]*Request),
+		cancelCh:      make(chan uint32, cancelQueueSize),
+		discarded:     make(map[uint32]time.Time),
+		sessions:      newSessionTable(),
 	}
+	mgr.Lock.Lock()
+	mgr.agents[agent] = struct{}{}
+	agent.limiter = mgr.limiter(nodeName)
+	agent.sessions.limiter = agent.limiter
+	mgr.Lock.Unlock()
 
 	go agent.WaitResponse()
 
@@ -68,170 +111,626 @@ func NewSenderAgent(nodeName string, conn netpoll.Connection) *SenderAgent {
 	return agent
 }
 
+// NewSenderAgent 创建的 agent 属于默认 Cluster, 断开时从默认 Cluster 的节点表中移除
+func NewSenderAgent(nodeName string, conn netpoll.Connection) *SenderAgent {
+	return defaultCluster.senders.newSenderAgent(nodeName, conn)
+}
+
 func (agent *SenderAgent) PostRequest(msg *codec.ReqPack) error {
 	writer := netpoll.NewLinkBuffer()
 	err := codec.EncodeReq(writer, msg)
 	if err != nil {
 		return err
 	}
+	agent.write(writer, 0)
+	return nil
+}
+
+// postQueued 同 PostRequest, pack.Size 字节已经在 limiter 中登记, 写出或者失败时释放
+func (agent *SenderAgent) postQueued(pack *codec.ReqPack) error {
+	writer := netpoll.NewLinkBuffer()
+	if err := codec.EncodeReq(writer, pack); err != nil {
+		agent.limiter.release(0, pack.Size)
+		return err
+	}
+	agent.write(writer, pack.Size)
+	return nil
+}
 
+// write 把编码好的 writer 放入发送队列, queued 为已经在 limiter 中登记的字节数
+func (agent *SenderAgent) write(writer *netpoll.LinkBuffer, queued int) {
+	agent.mgr.c.metrics.Bytes(agent.Name, DirectionOut, bufferSize(writer))
+
+	agent.queue(queued)
 	// Put puts the buffer getter back to the queue.
 	agent.wqueue.Add(func() (buf netpoll.Writer, isNil bool) {
+		agent.unqueue(queued)
+		if !agent.conn.IsActive() {
+			return nil, true
+		}
 		return writer, false
 	})
-	return nil
 }
 
-func (agent *SenderAgent) GenSession() uint32 {
-	session := agent.IncSession
-	agent.IncSession = session + 1
-	return session
+func newRequest() *Request {
+	return &Request{
+		RespCh: make(chan *codec.RespPack, 1),
+	}
+}
+
+func (req *Request) resolve(msg *codec.RespPack) {
+	if req.callback != nil {
+		req.callback(msg, nil)
+		return
+	}
+	req.RespCh <- msg
+}
+
+func (req *Request) fail(err error) {
+	if req.callback != nil {
+		req.callback(nil, err)
+		return
+	}
+	req.err = err
+	close(req.RespCh)
+}
+
+// InFlight 正在等待回应的请求数量
+func (agent *SenderAgent) InFlight() int {
+	return agent.sessions.len()
+}
+
+// Close 关闭链接, 等待中的请求返回 ErrConnClosed
+func (agent *SenderAgent) Close() {
+	agent.closeWith(ErrConnClosed)
+}
+
+func (agent *SenderAgent) closeWith(err error) {
+	agent.closeOnce.Do(func() {
+		agent.closeErr = err
+		close(agent.CloseCh)
+	})
 }
 
 func (agent *SenderAgent) WaitResponse() {
 	defer func() {
 		if err := recover(); err != nil {
-			if agent.conn.IsActive() {
-				agent.conn.Close()
-			}
+			agent.logger.Error("sender agent panic", "panic", err, "stack", string(debug.Stack()))
 		}
-		mgr := getSenderMgr()
+		if agent.conn.IsActive() {
+			agent.conn.Close()
+		}
+		mgr := agent.mgr
 		mgr.Lock.Lock()
-		delete(mgr.NodeAgent, agent.Name)
+		if p, ok := mgr.pools[agent.Name]; ok {
+			p.remove(agent)
+		}
+		delete(mgr.agents, agent)
 		mgr.Lock.Unlock()
-		for session, req := range agent.ReqSessions {
-			resp := &codec.RespPack{
-				Ok:      false,
-				Session: session,
-				Message: []byte("socket close"),
-			}
-			req.RespCh <- resp
+		// 被动断开时 closeErr 为 nil
+		agent.closeWith(ErrConnClosed)
+		agent.closeQueue()
+		pending := agent.sessions.removeAll()
+		for _, req := range pending {
+			req.fail(agent.closeErr)
 		}
+		agent.logger.Info("connection closed", "reason", agent.closeErr, "pending", len(pending))
 	}()
 
-	go func() error {
+	// 读 goroutine 退出时关闭 eof, 此时收到的包都已经放入 Recv
+	eof := make(chan struct{})
+	go func() {
+		defer close(eof)
 		for {
 			reader := agent.conn.Reader()
 			bLen, err := reader.ReadBinary(headerSize)
 			if err != nil {
-				return err
+				agent.logger.Debug("read response failed", "error", err)
+				return
 			}
 			pkgsize := int(binary.BigEndian.Uint16(bLen))
 			pkg, err := reader.Slice(pkgsize)
 			if err != nil {
-				return err
+				agent.logger.Debug("read response failed", "error", err)
+				return
+			}
+			agent.mgr.c.metrics.Bytes(agent.Name, DirectionIn, pkgsize+headerSize)
+			select {
+			case agent.Recv <- pkg:
+			case <-agent.CloseCh:
+				return
 			}
-			agent.Recv <- pkg
 		}
 	}()
 
-	var err error
-	var msg *codec.RespPack
+	sweeper := agent.mgr.c.newSweeper()
+	if sweeper != nil {
+		defer sweeper.Stop()
+	}
 	for {
 		select {
 		case pkg := <-agent.Recv:
-			msg, err = codec.DecodeResp(pkg, agent.LargeResponse)
-			if err != nil {
+			if !agent.handleResponse(pkg) {
 				return
 			}
-			if msg == nil {
-				continue
-			}
-			session := msg.Session
-			if req, ok := agent.ReqSessions[session]; ok {
-				req.RespCh <- msg
+		case <-eof:
+			// 对方关闭链接, 先处理已经收到的回应
+			for len(agent.Recv) > 0 {
+				if !agent.handleResponse(<-agent.Recv) {
+					return
+				}
 			}
+			return
+		case session := <-agent.cancelCh:
+			agent.freePartial(session)
+		case now := <-sweepC(sweeper):
+			agent.expire(now)
 		case <-agent.CloseCh:
 			return
 		}
 	}
 }
 
-func GetNodeSenderAgent(node string) (*SenderAgent, error) {
-	mgr := getSenderMgr()
-	if agent, ok := mgr.NodeAgent[node]; ok {
-		return agent, nil
+// handleResponse 解析回应并交给等待的请求, 返回 false 时关闭链接
+func (agent *SenderAgent) handleResponse(pkg netpoll.Reader) bool {
+	// session(4)+type(1)
+	header, _ := pkg.Peek(5)
+	var session uint32
+	var typ byte
+	if len(header) == 5 {
+		session, typ = binary.LittleEndian.Uint32(header), header[4]
+		if agent.discard(session, codec.RetType(typ)) {
+			pkg.Release()
+			return true
+		}
+	}
+	msg, err := codec.DecodeRespWithLimits(pkg, agent.LargeResponse, agent.mgr.c.limits)
+	if msg != nil && codec.IsLimitError(err) {
+		agent.mgr.c.metrics.DecodeError(agent.Name, typ)
+		agent.logger.Warn("drop multi part response", "session", msg.Session, "error", err)
+		agent.reject(msg.Session, err)
+		return true
 	}
+	if err != nil {
+		attrs := []any{"error", err}
+		if len(header) == 5 {
+			agent.mgr.c.metrics.DecodeError(agent.Name, typ)
+			attrs = append(attrs, packetTypeAttr(typ), "session", session)
+		}
+		agent.logger.Error("decode response failed, close connection", attrs...)
+		return false
+	}
+	if msg == nil {
+		return true
+	}
+	if msg.Multipart() {
+		agent.mgr.c.metrics.Multipart(agent.Name)
+	}
+	if req, ok := agent.sessions.remove(msg.Session); ok {
+		req.resolve(msg)
+	} else {
+		agent.late(msg.Session)
+	}
+	return true
+}
 
-	mgr.Lock.Lock()
-	addr, ok := GetRegisterNodeAddr(node)
-	mgr.Lock.Unlock()
+func (mgr *SenderMgr) backoff(failures int) time.Duration {
+	d := mgr.c.minBackoff << (failures - 1)
+	if d <= 0 || d > mgr.c.maxBackoff {
+		return mgr.c.maxBackoff
+	}
+	return d
+}
+
+func (mgr *SenderMgr) dialer(node string) *nodeDialer {
+	d, ok := mgr.dialers[node]
 	if !ok {
-		return nil, fmt.Errorf("not found tcp addr node:%s", node)
+		d = &nodeDialer{}
+		mgr.dialers[node] = d
 	}
-	conn, err := netpoll.DialConnection("tcp", addr, time.Second*5)
+	return d
+}
+
+func (mgr *SenderMgr) dial(ctx context.Context, node, addr string) (*SenderAgent, error) {
+	conn, err := netpoll.DialConnection("tcp", addr, mgr.c.dialTimeout)
 	if err != nil {
 		return nil, err
 	}
+	// 链接断开时 WaitResponse 处理完已经收到的回应后关闭 agent
+	agent := mgr.newSenderAgent(node, conn)
+	if mgr.c.propagateDeadline {
+		if err := agent.negotiate(ctx, mgr.c.dialTimeout); err != nil {
+			agent.closeWith(err)
+			return nil, err
+		}
+	}
+	return agent, nil
+}
 
-	agent := NewSenderAgent(node, conn)
-	conn.AddCloseCallback(func(connection netpoll.Connection) error {
-		agent.CloseCh <- struct{}{}
-		return nil
-	})
+// getNodeSenderAgent 获取节点的链接, 没有链接时建立链接, 节点未注册时按 nowaiting 等待或者返回错误
+func (mgr *SenderMgr) getNodeSenderAgent(ctx context.Context, node string) (*SenderAgent, error) {
+	return mgr.getAgent(ctx, node, false)
+}
+
+// getAgent 按 pool 的配置选择节点的链接, large 为 true 时使用大包专用的链接
+// 同一个节点同时只有一个 goroutine 建立链接, 连续失败后下次建立链接前需要等待退避时间
+func (mgr *SenderMgr) getAgent(ctx context.Context, node string, large bool) (*SenderAgent, error) {
+	policy := mgr.c.poolPolicy
+	slot := noSlot
+	mgr.Lock.RLock()
+	if p, ok := mgr.pools[node]; ok {
+		var agent *SenderAgent
+		if agent, slot = p.pick(policy, large); agent != nil {
+			mgr.Lock.RUnlock()
+			return agent, nil
+		}
+	}
+	mgr.Lock.RUnlock()
+
+	for {
+		addr, err := mgr.c.nodes.waitAddr(ctx, node)
+		if err != nil {
+			return nil, err
+		}
 
+		mgr.Lock.Lock()
+		if mgr.closed {
+			mgr.Lock.Unlock()
+			return nil, ErrShutdown
+		}
+		// 已经选中的位置不再重新选择, 保证轮流使用时每个位置都会建立链接
+		var agent *SenderAgent
+		if slot == noSlot {
+			agent, slot = mgr.pool(node).pick(policy, large)
+		} else {
+			agent = mgr.pool(node).get(slot)
+		}
+		if agent != nil {
+			mgr.Lock.Unlock()
+			return agent, nil
+		}
+		d := mgr.dialer(node)
+		if d.err != nil && d.addr == addr && time.Now().Before(d.retryAt) {
+			mgr.Lock.Unlock()
+			return nil, d.err
+		}
+		if done := d.done; done != nil {
+			// 正在建立其他链接时先使用已有的链接
+			if agent := mgr.pools[node].any(); agent != nil && !large {
+				mgr.Lock.Unlock()
+				return agent, nil
+			}
+			mgr.Lock.Unlock()
+			select {
+			case <-done:
+				continue
+			case <-ctx.Done():
+				return nil, ctxErr(ctx)
+			}
+		}
+		d.done = make(chan struct{})
+		mgr.Lock.Unlock()
+
+		agent, err = mgr.dial(ctx, node, addr)
+
+		mgr.Lock.Lock()
+		close(d.done)
+		d.done = nil
+		if err != nil {
+			if ctx.Err() == nil {
+				d.failures++
+				d.retryAt = time.Now().Add(mgr.backoff(d.failures))
+				d.addr, d.err = addr, err
+			}
+			reconnect := mgr.connected[node]
+			failures := d.failures
+			mgr.Lock.Unlock()
+			mgr.c.metrics.Connect(node, reconnect, err)
+			mgr.c.log().Warn("dial node failed", "node", node, "remote_addr", addr, "failures", failures, "error", err)
+			return nil, err
+		}
+		d.failures = 0
+		d.retryAt = time.Time{}
+		d.addr, d.err = "", nil
+		if mgr.closed {
+			mgr.Lock.Unlock()
+			agent.closeWith(ErrShutdown)
+			return nil, ErrShutdown
+		}
+		if cur, _ := mgr.c.nodes.addr(node); cur != addr {
+			// 建立链接期间节点地址发生了变化
+			mgr.Lock.Unlock()
+			agent.closeWith(ErrNodeChanged)
+			continue
+		}
+		mgr.pool(node).set(slot, agent)
+		reconnect := mgr.connected[node]
+		mgr.connected[node] = true
+		mgr.Lock.Unlock()
+		mgr.c.metrics.Connect(node, reconnect, nil)
+		agent.logger.Info("connected to node", "reconnect", reconnect, "slot", slot, "deadline", agent.deadline)
+		return agent, nil
+	}
+}
+
+func (mgr *SenderMgr) pool(node string) *nodePool {
+	p, ok := mgr.pools[node]
+	if !ok {
+		p = newNodePool(mgr.c.poolSize)
+		mgr.pools[node] = p
+	}
+	return p
+}
+
+// detachNode 从节点表中移除节点的所有链接, 下次请求时重新建立链接
+func (mgr *SenderMgr) detachNode(node string) []*SenderAgent {
 	mgr.Lock.Lock()
-	if _, ok := mgr.NodeAgent[node]; !ok {
-		mgr.NodeAgent[node] = agent
-	} else {
-		agent.CloseCh <- struct{}{}
+	defer mgr.Lock.Unlock()
+	var agents []*SenderAgent
+	if p, ok := mgr.pools[node]; ok {
+		agents = p.all()
+		delete(mgr.pools, node)
 	}
-	mgr.Lock.Unlock()
-	return agent, nil
+	if d, exist := mgr.dialers[node]; exist && d.done == nil {
+		delete(mgr.dialers, node)
+	}
+	return agents
 }
 
-func Call(ctx context.Context, node, service, cmd string, args string) (bool, string) {
-	agent, err := GetNodeSenderAgent(node)
+// closeNode 关闭节点的链接, 等待中的请求返回 err
+// 对应 skynet clustersender 的 changenode
+func (mgr *SenderMgr) closeNode(node string, err error) {
+	for _, agent := range mgr.detachNode(node) {
+		agent.logger.Info("close node connection", "reason", err, "pending", agent.InFlight())
+		agent.closeWith(err)
+	}
+}
+
+// drainNode 节点的链接不再接受新的请求, 等待中的请求完成或者超时后关闭链接
+func (mgr *SenderMgr) drainNode(node string, timeout time.Duration) {
+	for _, agent := range mgr.detachNode(node) {
+		agent.logger.Info("drain node connection", "pending", agent.InFlight(), "timeout", timeout)
+		go agent.drain(timeout)
+	}
+}
+
+func (agent *SenderAgent) drain(timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+	for agent.InFlight() > 0 {
+		select {
+		case <-ticker.C:
+		case <-timer.C:
+			agent.closeWith(ErrConnClosed)
+			return
+		case <-agent.CloseCh:
+			return
+		}
+	}
+	agent.closeWith(ErrConnClosed)
+}
+
+func (c *Cluster) GetNodeSenderAgent(node string) (*SenderAgent, error) {
+	return c.senders.getNodeSenderAgent(context.Background(), node)
+}
+
+func GetNodeSenderAgent(node string) (*SenderAgent, error) {
+	return defaultCluster.GetNodeSenderAgent(node)
+}
+
+// request 发送请求并等待回应, session 由 agent 分配
+// 远端返回错误时返回 *RemoteError
+func (c *Cluster) request(ctx context.Context, node string, pack *codec.ReqPack) (*codec.RespPack, error) {
+	start := time.Now()
+	ctx, span := c.startSpan(ctx, trace.SpanKindClient, pack, attrNode.String(node))
+	msg, err := c.roundTrip(ctx, node, pack)
+	setSpanPack(span, pack)
+	endSpan(span, err)
+	c.metrics.CallDone(node, serviceName(pack.Addr), pack.Cmd, time.Since(start), err)
+	return msg, err
+}
+
+func (c *Cluster) roundTrip(ctx context.Context, node string, pack *codec.ReqPack) (*codec.RespPack, error) {
+	resp := newRequest()
+	agent, err := c.post(ctx, node, pack, resp)
 	if err != nil {
-		return false, err.Error()
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		agent.cancel(pack.Session)
+		return nil, ctxErr(ctx)
+	case msg, ok := <-resp.RespCh:
+		if !ok {
+			return nil, resp.err
+		}
+		return msg, remoteError(node, pack, msg)
+	}
+}
+
+// post 登记 req 并发送请求, 返回 error 时 req 已经从 session 中移除
+func (c *Cluster) post(ctx context.Context, node string, pack *codec.ReqPack, req *Request) (*SenderAgent, error) {
+	if err := pack.Pack(); err != nil {
+		return nil, err
+	}
+	agent, err := c.senders.getAgent(ctx, node, c.isLarge(ctx, pack))
+	if err != nil {
+		return nil, err
+	}
+	if err := agent.limiter.acquire(ctx, 1, pack.Size); err != nil {
+		return nil, err
+	}
+	pack.Trace = c.outboundTraceTag(ctx)
+	pack.Session = agent.sessions.add(req)
+
+	select {
+	case <-agent.CloseCh:
+		// 链接已经关闭, WaitResponse 清理 session 之后登记的请求由这里返回
+		agent.limiter.release(0, pack.Size)
+		if _, ok := agent.sessions.remove(pack.Session); ok {
+			return nil, agent.closeErr
+		}
+	default:
+		err = agent.postQueued(agent.withDeadline(ctx, pack))
+		if err != nil {
+			agent.sessions.remove(pack.Session)
+			return nil, err
+		}
+	}
+	return agent, nil
+}
+
+// remoteError 远端返回错误时转换为 *RemoteError
+func remoteError(node string, pack *codec.ReqPack, msg *codec.RespPack) error {
+	if msg.Ok {
+		return nil
+	}
+	return &RemoteError{
+		Node:    node,
+		Service: pack.Addr.Name,
+		Cmd:     pack.Cmd,
+		Message: string(msg.Message),
+	}
+}
+
+// push 发送请求不需要回应, 对应 cluster.send
+func (c *Cluster) push(ctx context.Context, node string, pack *codec.ReqPack) error {
+	ctx, span := c.startSpan(ctx, trace.SpanKindProducer, pack, attrNode.String(node))
+	pack.Session = 0
+	err := pack.Pack()
+	var agent *SenderAgent
+	if err == nil {
+		agent, err = c.senders.getAgent(ctx, node, c.isLarge(ctx, pack))
 	}
+	if err == nil {
+		err = agent.limiter.acquire(ctx, 0, pack.Size)
+	}
+	if err == nil {
+		pack.Trace = c.outboundTraceTag(ctx)
+		err = agent.postQueued(pack)
+	}
+	setSpanPack(span, pack)
+	endSpan(span, err)
+	c.metrics.SendDone(node, serviceName(pack.Addr), pack.Cmd, err)
+	return err
+}
+
+func (c *Cluster) Call(ctx context.Context, node, service, cmd string, args string) (bool, string) {
 	pack := &codec.ReqPack{
 		Addr: codec.Addr{
 			Id:   0,
 			Name: service,
 		},
-		Session: agent.GenSession(),
 		Cmd:     cmd,
 		Message: []byte(args),
 	}
-
-	resp := &Request{
-		RespCh: make(chan *codec.RespPack),
-	}
-	agent.ReqSessions[pack.Session] = resp
-
-	err = agent.PostRequest(pack)
+	msg, err := c.request(ctx, node, pack)
 	if err != nil {
+		var remoteErr *RemoteError
+		if errors.As(err, &remoteErr) {
+			return false, remoteErr.Message
+		}
 		return false, err.Error()
 	}
+	return msg.Ok, msg.Text()
+}
 
-	select {
-	case <-ctx.Done():
-		return false, "timeout"
-	case msg := <-resp.RespCh:
-		return msg.Ok, string(msg.Message)
+func Call(ctx context.Context, node, service, cmd string, args string) (bool, string) {
+	return defaultCluster.Call(ctx, node, service, cmd, args)
+}
+
+// CallMulti 对应 cluster.call(node, service, cmd, ...), 返回远端的所有返回值
+func (c *Cluster) CallMulti(ctx context.Context, node, service, cmd string, args ...any) ([]any, error) {
+	if args == nil {
+		args = []any{}
 	}
+	pack := &codec.ReqPack{
+		Addr: codec.Addr{
+			Id:   0,
+			Name: service,
+		},
+		Cmd:  cmd,
+		Args: args,
+	}
+	msg, err := c.request(ctx, node, pack)
+	if err != nil {
+		return nil, err
+	}
+	return msg.Results, nil
 }
 
-func Send(ctx context.Context, node, service, cmd string, args string) error {
-	agent, err := GetNodeSenderAgent(node)
+func CallMulti(ctx context.Context, node, service, cmd string, args ...any) ([]any, error) {
+	return defaultCluster.CallMulti(ctx, node, service, cmd, args...)
+}
+
+// CallTyped 把 req 按 codec.Marshal 的规则作为一个参数发送, 第一个返回值解析到 Resp
+// 错误可以用 errors.Is 判断 ErrNodeNotFound/ErrTimeout/ErrConnClosed, errors.As 获取 *RemoteError
+func CallTyped[Req, Resp any](ctx context.Context, node, service, cmd string, req Req) (Resp, error) {
+	return CallTypedOn[Req, Resp](ctx, defaultCluster, node, service, cmd, req)
+}
+
+// CallTypedOn 同 CallTyped, 使用指定的 Cluster 发送请求
+func CallTypedOn[Req, Resp any](ctx context.Context, c *Cluster, node, service, cmd string, req Req) (Resp, error) {
+	var resp Resp
+	arg, err := codec.ToLua(req)
 	if err != nil {
-		return err
+		return resp, err
+	}
+	pack := &codec.ReqPack{
+		Addr: codec.Addr{
+			Id:   0,
+			Name: service,
+		},
+		Cmd:  cmd,
+		Args: []any{arg},
+	}
+	msg, err := c.request(ctx, node, pack)
+	if err != nil {
+		return resp, err
+	}
+	var result any
+	if len(msg.Results) > 0 {
+		result = msg.Results[0]
 	}
+	err = codec.FromLua(result, &resp)
+	return resp, err
+}
 
+func (c *Cluster) Send(ctx context.Context, node, service, cmd string, args string) error {
 	pack := &codec.ReqPack{
 		Addr: codec.Addr{
 			Id:   0,
 			Name: service,
 		},
-		Session: 0,
 		Cmd:     cmd,
 		Message: []byte(args),
 	}
+	return c.push(ctx, node, pack)
+}
 
-	err = agent.PostRequest(pack)
-	if err != nil {
-		return err
+func Send(ctx context.Context, node, service, cmd string, args string) error {
+	return defaultCluster.Send(ctx, node, service, cmd, args)
+}
+
+// SendMulti 对应 cluster.send(node, service, cmd, ...)
+func (c *Cluster) SendMulti(ctx context.Context, node, service, cmd string, args ...any) error {
+	if args == nil {
+		args = []any{}
 	}
-	return nil
+	pack := &codec.ReqPack{
+		Addr: codec.Addr{
+			Id:   0,
+			Name: service,
+		},
+		Cmd:  cmd,
+		Args: args,
+	}
+	return c.push(ctx, node, pack)
+}
+
+func SendMulti(ctx context.Context, node, service, cmd string, args ...any) error {
+	return defaultCluster.SendMulti(ctx, node, service, cmd, args...)
 }
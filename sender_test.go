@@ -0,0 +1,138 @@
+package skynetclusterd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestChangeNode(t *testing.T) {
+	addrA := startTestNode(t, "change_a")
+	addrB := startTestNode(t, "change_b")
+
+	release := make(chan struct{})
+	svc := NewService("where")
+	svc.Handle("block", func(ctx context.Context, args []byte) ([]byte, error) {
+		<-release
+		return nil, nil
+	})
+	RegisterService(svc)
+	defer UnRegisterService("where")
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	RegisterNode("change", addrA)
+	agentA, err := GetNodeSenderAgent("change")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 等待中的请求在节点地址变化后返回 ErrNodeChanged
+	errCh := make(chan error)
+	go func() {
+		_, err := CallMulti(ctx, "change", "where", "block")
+		errCh <- err
+	}()
+	for agentA.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	RegisterNode("change", addrB)
+	if err := <-errCh; !errors.Is(err, ErrNodeChanged) {
+		t.Errorf("pending call got %v want %v", err, ErrNodeChanged)
+	}
+
+	agentB, err := GetNodeSenderAgent("change")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agentA == agentB || agentB.conn.RemoteAddr().String() != addrB {
+		t.Errorf("sender not reconnect to %s", addrB)
+	}
+	UnRegisterNode("change")
+}
+
+func TestDialBackoff(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	RegisterNode("backoff", addr)
+	defer UnRegisterNode("backoff")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := Send(ctx, "backoff", "svc", "cmd", ""); err == nil {
+		t.Fatal("send to closed port expect error")
+	}
+
+	// 退避时间内直接返回上次的错误, 并发的请求不会依次等待建立链接
+	errs := make(chan error, 20)
+	start := time.Now()
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			errs <- Send(ctx, "backoff", "svc", "cmd", "")
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err == nil || errors.Is(err, ErrTimeout) {
+			t.Errorf("send in backoff got %v", err)
+		}
+	}
+	if d := time.Since(start); d > defaultMinBackoff*2 {
+		t.Errorf("send in backoff took %v", d)
+	}
+
+	// 节点重新启动后可以自动重连
+	startTestNode(t, "backoff_up")
+	RegisterNode("backoff", getAddr(t, "backoff_up"))
+	if err := Send(ctx, "backoff", "svc", "cmd", ""); err != nil {
+		t.Errorf("send after node up got %v", err)
+	}
+}
+
+func getAddr(t *testing.T, node string) string {
+	addr, ok := GetRegisterNodeAddr(node)
+	if !ok {
+		t.Fatalf("node %s not registered", node)
+	}
+	return addr
+}
+
+func TestWaitNode(t *testing.T) {
+	addr := startTestNode(t, "wait_up")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	SetNodeDown("wait")
+	defer UnRegisterNode("wait")
+	if err := Send(ctx, "wait", "svc", "cmd", ""); !errors.Is(err, ErrNodeDown) {
+		t.Errorf("send to down node got %v want %v", err, ErrNodeDown)
+	}
+
+	SetNoWaiting(false)
+	defer SetNoWaiting(true)
+
+	short, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := Send(short, "wait", "svc", "cmd", ""); !errors.Is(err, ErrTimeout) {
+		t.Errorf("wait down node got %v want %v", err, ErrTimeout)
+	}
+
+	// 节点重新注册后唤醒等待的请求
+	errCh := make(chan error)
+	go func() {
+		errCh <- Send(ctx, "wait", "svc", "cmd", "")
+	}()
+	time.Sleep(10 * time.Millisecond)
+	RegisterNode("wait", addr)
+	if err := <-errCh; err != nil {
+		t.Errorf("wait node got %v", err)
+	}
+}
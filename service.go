@@ -0,0 +1,173 @@
+package skynetclusterd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/changlongH/skynet_cluster/codec"
+)
+
+type (
+	// HandlerFunc 处理一个远端请求, args 为 lua 端 cluster.call/send 传入的参数
+	// 返回值作为 cluster.call 的返回值, error 则回复给调用方一个错误
+	HandlerFunc func(ctx context.Context, args []byte) ([]byte, error)
+
+	// MultiHandlerFunc 处理多参数请求, 返回多个值, 对应 lua 的 function(...) return a, b, c end
+	MultiHandlerFunc func(ctx context.Context, args []any) ([]any, error)
+
+	handler func(ctx context.Context, msg *codec.ReqPack) (*codec.RespPack, error)
+
+	// Service 一个可以被 skynet 节点访问的 go 服务, 按 cmd 分发请求
+	Service struct {
+		sync.RWMutex
+		Name     string
+		handlers map[string]handler
+		workers  int // 每个链接上处理请求的 goroutine 数量
+	}
+
+	serviceRegister struct {
+		sync.RWMutex
+		names map[string]*Service // Addr.Name -> service
+		ids   map[uint32]*Service // Addr.Id -> service
+	}
+)
+
+func newServiceRegister() *serviceRegister {
+	return &serviceRegister{
+		names: make(map[string]*Service),
+		ids:   make(map[uint32]*Service),
+	}
+}
+
+func NewService(name string) *Service {
+	return &Service{
+		Name:     name,
+		handlers: make(map[string]handler),
+	}
+}
+
+// Handle 注册 cmd 的处理函数, 重复注册会覆盖
+func (svc *Service) Handle(cmd string, fn HandlerFunc) *Service {
+	return svc.handle(cmd, func(ctx context.Context, msg *codec.ReqPack) (*codec.RespPack, error) {
+		data, err := fn(ctx, msg.Bytes())
+		return &codec.RespPack{Message: data}, err
+	})
+}
+
+// HandleMulti 注册 cmd 的多参数处理函数, 重复注册会覆盖
+func (svc *Service) HandleMulti(cmd string, fn MultiHandlerFunc) *Service {
+	return svc.handle(cmd, func(ctx context.Context, msg *codec.ReqPack) (*codec.RespPack, error) {
+		results, err := fn(ctx, msg.Args)
+		if results == nil {
+			results = []any{}
+		}
+		return &codec.RespPack{Results: results}, err
+	})
+}
+
+func (svc *Service) handle(cmd string, h handler) *Service {
+	svc.Lock()
+	defer svc.Unlock()
+	svc.handlers[cmd] = h
+	return svc
+}
+
+func (svc *Service) getHandler(cmd string) (handler, bool) {
+	svc.RLock()
+	defer svc.RUnlock()
+	handler, ok := svc.handlers[cmd]
+	return handler, ok
+}
+
+// serve 调用 cmd 对应的处理函数, handler panic 时转成错误返回
+func (svc *Service) serve(ctx context.Context, msg *codec.ReqPack) (resp *codec.RespPack, err error) {
+	handler, ok := svc.getHandler(msg.Cmd)
+	if !ok {
+		return nil, fmt.Errorf("unknown cmd:%s service:%s", msg.Cmd, svc.Name)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("service:%s cmd:%s panic: %v", svc.Name, msg.Cmd, r)
+		}
+	}()
+	return handler(ctx, msg)
+}
+
+// RegisterService 按名字注册服务, 对应 cluster.call(node, "name", ...)
+func (c *Cluster) RegisterService(svc *Service) {
+	c.services.Lock()
+	defer c.services.Unlock()
+	c.services.names[svc.Name] = svc
+}
+
+func RegisterService(svc *Service) {
+	defaultCluster.RegisterService(svc)
+}
+
+// RegisterServiceId 按数字地址注册服务, 对应 cluster.call(node, id, ...)
+func (c *Cluster) RegisterServiceId(id uint32, svc *Service) {
+	c.services.Lock()
+	defer c.services.Unlock()
+	c.services.ids[id] = svc
+}
+
+func RegisterServiceId(id uint32, svc *Service) {
+	defaultCluster.RegisterServiceId(id, svc)
+}
+
+func (c *Cluster) UnRegisterService(name string) {
+	c.services.Lock()
+	defer c.services.Unlock()
+	delete(c.services.names, name)
+}
+
+func UnRegisterService(name string) {
+	defaultCluster.UnRegisterService(name)
+}
+
+func (c *Cluster) UnRegisterServiceId(id uint32) {
+	c.services.Lock()
+	defer c.services.Unlock()
+	delete(c.services.ids, id)
+}
+
+func UnRegisterServiceId(id uint32) {
+	defaultCluster.UnRegisterServiceId(id)
+}
+
+func (c *Cluster) GetService(addr codec.Addr) (*Service, bool) {
+	c.services.RLock()
+	defer c.services.RUnlock()
+	return c.services.lookup(addr)
+}
+
+func GetService(addr codec.Addr) (*Service, bool) {
+	return defaultCluster.GetService(addr)
+}
+
+// lookup 需要持有锁, skynet cluster.register 的服务按 "@name" 发送, 去掉 @ 后查找
+func (r *serviceRegister) lookup(addr codec.Addr) (*Service, bool) {
+	if addr.Name != "" {
+		svc, ok := r.names[strings.TrimPrefix(addr.Name, "@")]
+		return svc, ok
+	}
+	svc, ok := r.ids[addr.Id]
+	return svc, ok
+}
+
+func (c *Cluster) dispatch(ctx context.Context, msg *codec.ReqPack) (*codec.RespPack, error) {
+	if msg.Addr.Name == deadlineService {
+		return &codec.RespPack{Results: []any{int64(deadlineVersion)}}, nil
+	}
+	svc, ok := c.GetService(msg.Addr)
+	if !ok {
+		if msg.Addr.Name != "" {
+			return nil, fmt.Errorf("unknown service name:%s", msg.Addr.Name)
+		}
+		return nil, fmt.Errorf("unknown service id:%d", msg.Addr.Id)
+	}
+	return svc.serve(ctx, msg)
+}
@@ -0,0 +1,104 @@
+package skynetclusterd
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	sessionShardSize = 32
+	maxSession       = 0x7fffffff // 同 skynet, session 超过 INT32_MAX 后从 1 开始
+)
+
+type (
+	sessionShard struct {
+		sync.Mutex
+		reqs map[uint32]*Request
+	}
+
+	// sessionTable 分片的 session -> Request 表, 可以被多个 goroutine 同时访问
+	sessionTable struct {
+		next    atomic.Uint32
+		shards  [sessionShardSize]sessionShard
+		limiter *limiter // 非 nil 时移除 session 后释放等待回应的请求数量
+	}
+)
+
+func newSessionTable() *sessionTable {
+	t := &sessionTable{}
+	for i := range t.shards {
+		t.shards[i].reqs = make(map[uint32]*Request)
+	}
+	return t
+}
+
+func (t *sessionTable) shard(session uint32) *sessionShard {
+	return &t.shards[session%sessionShardSize]
+}
+
+// add 分配一个未被使用的 session 并登记 req, 回绕后跳过仍在等待回应的 session
+func (t *sessionTable) add(req *Request) uint32 {
+	for {
+		session := t.next.Add(1) & maxSession
+		if session == 0 {
+			continue
+		}
+		s := t.shard(session)
+		s.Lock()
+		if _, ok := s.reqs[session]; !ok {
+			s.reqs[session] = req
+			s.Unlock()
+			return session
+		}
+		s.Unlock()
+	}
+}
+
+// remove 取出并删除 session, 同一个 session 只有一个调用方能取到
+func (t *sessionTable) remove(session uint32) (*Request, bool) {
+	s := t.shard(session)
+	s.Lock()
+	defer s.Unlock()
+	req, ok := s.reqs[session]
+	if ok {
+		delete(s.reqs, session)
+		t.limiter.release(1, 0)
+	}
+	return req, ok
+}
+
+func (t *sessionTable) has(session uint32) bool {
+	s := t.shard(session)
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.reqs[session]
+	return ok
+}
+
+// removeAll 取出并删除所有 session
+func (t *sessionTable) removeAll() map[uint32]*Request {
+	all := make(map[uint32]*Request)
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.Lock()
+		for session, req := range s.reqs {
+			all[session] = req
+		}
+		s.reqs = make(map[uint32]*Request)
+		s.Unlock()
+	}
+	t.limiter.release(len(all), 0)
+	return all
+}
+
+// len 正在等待回应的 session 数量
+func (t *sessionTable) len() int {
+	n := 0
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.Lock()
+		n += len(s.reqs)
+		s.Unlock()
+	}
+	return n
+}
@@ -0,0 +1,93 @@
+package skynetclusterd
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSessionWraparound(t *testing.T) {
+	table := newSessionTable()
+	table.next.Store(maxSession - 2)
+
+	first := table.add(newRequest())
+	if first != maxSession-1 {
+		t.Fatalf("session got %d want %d", first, maxSession-1)
+	}
+	table.add(newRequest()) // maxSession
+	// 回绕后跳过 0, 且跳过仍在使用中的 1
+	table.next.Store(0)
+	inflight := table.add(newRequest())
+	table.next.Store(maxSession)
+	if s := table.add(newRequest()); s != inflight+1 {
+		t.Errorf("session got %d want %d", s, inflight+1)
+	}
+	if _, ok := table.remove(first); !ok {
+		t.Errorf("remove session %d failed", first)
+	}
+	if _, ok := table.remove(first); ok {
+		t.Errorf("remove session %d twice", first)
+	}
+	if n := table.len(); n != 3 {
+		t.Errorf("len got %d want 3", n)
+	}
+}
+
+// go test -race -run TestConcurrentCall
+func TestConcurrentCall(t *testing.T) {
+	startTestNode(t, "concurrent")
+
+	svc := NewService("concurrent")
+	svc.Handle("echo", func(ctx context.Context, args []byte) ([]byte, error) {
+		return args, nil
+	})
+	RegisterService(svc)
+	defer UnRegisterService("concurrent")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	const n = 5000
+	var wg sync.WaitGroup
+	errs := make(chan string, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			args := strconv.Itoa(i)
+			ok, resp := Call(ctx, "concurrent", "concurrent", "echo", args)
+			if !ok || resp != args {
+				errs <- resp
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for resp := range errs {
+		t.Errorf("unexpected resp %s", resp)
+	}
+
+	agent, err := GetNodeSenderAgent("concurrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := agent.InFlight(); n != 0 {
+		t.Errorf("in flight sessions %d after all calls done", n)
+	}
+
+	// 超时的请求也要从 session 表中删除
+	svc.Handle("slow", func(ctx context.Context, args []byte) ([]byte, error) {
+		time.Sleep(100 * time.Millisecond)
+		return args, nil
+	})
+	timeout, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := CallMulti(timeout, "concurrent", "concurrent", "slow"); err != ErrTimeout {
+		t.Errorf("slow call got %v want %v", err, ErrTimeout)
+	}
+	if n := agent.InFlight(); n != 0 {
+		t.Errorf("in flight sessions %d after timeout", n)
+	}
+}
@@ -0,0 +1,105 @@
+package skynetclusterd
+
+import (
+	"context"
+	"time"
+)
+
+// ShutdownReport Shutdown 处理完成和丢弃的请求数量
+type ShutdownReport struct {
+	RecvDrained   int // 关闭前处理完成的请求包
+	RecvAbandoned int // 超时未处理的请求包, 包括未收完的 multi part 请求
+	SendDrained   int // 关闭前收到回应的请求
+	SendFailed    int // 超时后返回 ErrShutdown 的请求
+}
+
+// Shutdown 关闭 cluster 节点, ctx 结束前尽量完成已经收到和发出的请求
+//  1. 不再接受新的链接
+//  2. 处理已经收到的请求 (包括 mailbox 中的请求) 并等待回应发送完成, 然后关闭链接
+//  3. 不再接受新的请求, 等待发出的请求收到回应, ctx 结束后剩下的请求返回 ErrShutdown
+//  4. 关闭监听
+//
+// ctx 结束前没有全部完成时返回 ErrTimeout 或者 ctx.Err()
+func (c *Cluster) Shutdown(ctx context.Context) (ShutdownReport, error) {
+	var report ShutdownReport
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return report, ErrShutdown
+	}
+	c.closed = true
+	eventLoop := c.eventLoop
+	receivers := make([]*RecvAgent, 0, len(c.receivers))
+	for agent := range c.receivers {
+		agent.queued = int(agent.mailed.Load())
+		receivers = append(receivers, agent)
+	}
+	c.mu.Unlock()
+
+	for _, agent := range receivers {
+		agent.drainCh <- ctx
+	}
+	for _, agent := range receivers {
+		select {
+		case <-agent.done:
+			report.RecvDrained += agent.drained
+			report.RecvAbandoned += agent.abandoned
+		case <-ctx.Done():
+			// handler 还没有返回, 取消 handler 的 ctx 并关闭链接
+			report.RecvAbandoned += len(agent.Recv)
+			agent.cancel()
+			agent.conn.Close()
+		}
+	}
+
+	report.SendDrained, report.SendFailed = c.senders.shutdown(ctx)
+
+	if eventLoop != nil {
+		eventLoop.Shutdown(ctx)
+	}
+	if b, ok := c.metrics.(metricsBinder); ok {
+		b.unbind(c)
+	}
+	if ctx.Err() != nil {
+		return report, ctxErr(ctx)
+	}
+	return report, nil
+}
+
+// shutdown 不再建立新的链接, 等待发出的请求收到回应, ctx 结束后关闭所有链接
+// 返回收到回应和返回 ErrShutdown 的请求数量
+func (mgr *SenderMgr) shutdown(ctx context.Context) (int, int) {
+	mgr.Lock.Lock()
+	mgr.closed = true
+	mgr.pools = map[string]*nodePool{}
+	agents := make([]*SenderAgent, 0, len(mgr.agents))
+	for agent := range mgr.agents {
+		agents = append(agents, agent)
+	}
+	mgr.Lock.Unlock()
+
+	inflight := func() int {
+		n := 0
+		for _, agent := range agents {
+			n += agent.InFlight()
+		}
+		return n
+	}
+
+	total := inflight()
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+	for inflight() > 0 && ctx.Err() == nil {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+		}
+	}
+
+	failed := inflight()
+	for _, agent := range agents {
+		agent.closeWith(ErrShutdown)
+	}
+	return max(total-failed, 0), failed
+}
@@ -0,0 +1,146 @@
+package skynetclusterd
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShutdownDrainRecv(t *testing.T) {
+	server, client := New(), New()
+	addr := listenTestCluster(t, server)
+	client.RegisterNode("server", addr)
+	defer client.Shutdown(context.Background())
+
+	var started atomic.Int32
+	release := make(chan struct{})
+	svc := NewService("slow")
+	svc.Handle("wait", func(ctx context.Context, args []byte) ([]byte, error) {
+		started.Add(1)
+		<-release
+		return args, nil
+	})
+	server.RegisterService(svc)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	const n = 5
+	var wg sync.WaitGroup
+	errs := make(chan string, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, resp := client.Call(ctx, "server", "slow", "wait", "done"); !ok || resp != "done" {
+				errs <- resp
+			}
+		}()
+	}
+
+	// 第一个请求在 handler 中, 其余的请求在服务的 mailbox 中等待时开始关闭
+	var agent *RecvAgent
+	for agent == nil || started.Load() != 1 || agent.mailed.Load() != n {
+		time.Sleep(time.Millisecond)
+		server.mu.Lock()
+		for a := range server.receivers {
+			agent = a
+		}
+		server.mu.Unlock()
+	}
+	type result struct {
+		report ShutdownReport
+		err    error
+	}
+	done := make(chan result)
+	go func() {
+		report, err := server.Shutdown(ctx)
+		done <- result{report, err}
+	}()
+	for closed := false; !closed; {
+		time.Sleep(time.Millisecond)
+		server.mu.Lock()
+		closed = server.closed
+		server.mu.Unlock()
+	}
+	close(release)
+	res := <-done
+	report, err := res.report, res.err
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	close(errs)
+	for resp := range errs {
+		t.Errorf("call during shutdown got %q", resp)
+	}
+	if report.RecvDrained != n || report.RecvAbandoned != 0 {
+		t.Errorf("report got %+v", report)
+	}
+
+	// 关闭后不再接受新的链接
+	other := New()
+	other.RegisterNode("server", addr)
+	short, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	if ok, _ := other.Call(short, "server", "slow", "wait", ""); ok {
+		t.Error("call after shutdown expect error")
+	}
+	if _, err := server.Shutdown(ctx); !errors.Is(err, ErrShutdown) {
+		t.Errorf("shutdown twice got %v want %v", err, ErrShutdown)
+	}
+}
+
+func TestShutdownFailSend(t *testing.T) {
+	server, client := New(), New()
+	addr := listenTestCluster(t, server)
+	client.RegisterNode("server", addr)
+
+	release := make(chan struct{})
+	svc := NewService("block")
+	svc.Handle("wait", func(ctx context.Context, args []byte) ([]byte, error) {
+		<-release
+		return nil, nil
+	})
+	svc.Handle("echo", func(ctx context.Context, args []byte) ([]byte, error) {
+		return args, nil
+	})
+	server.RegisterService(svc)
+	defer server.Shutdown(context.Background())
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	agent, err := client.GetNodeSenderAgent("server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errCh := make(chan error)
+	go func() {
+		_, err := client.CallMulti(ctx, "server", "block", "wait")
+		errCh <- err
+	}()
+	for agent.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	short, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	report, err := client.Shutdown(short)
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("shutdown got %v want %v", err, ErrTimeout)
+	}
+	if report.SendFailed != 1 || report.SendDrained != 0 {
+		t.Errorf("report got %+v", report)
+	}
+	if err := <-errCh; !errors.Is(err, ErrShutdown) {
+		t.Errorf("pending call got %v want %v", err, ErrShutdown)
+	}
+	if _, err := client.CallMulti(ctx, "server", "block", "echo"); !errors.Is(err, ErrShutdown) {
+		t.Errorf("call after shutdown got %v want %v", err, ErrShutdown)
+	}
+}
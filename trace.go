@@ -0,0 +1,17 @@
+package skynetclusterd
+
+import "context"
+
+type tracekey struct{}
+
+// WithTraceTag 返回携带 skynet trace tag 的 ctx, 使用这个 ctx 的 Call/Send 会在请求之前发送 trace 包
+// 对应 lua 端的 skynet.trace(), 远端收到后同一个 tag 的日志可以串起来
+func WithTraceTag(ctx context.Context, tag string) context.Context {
+	return context.WithValue(ctx, tracekey{}, tag)
+}
+
+// TraceTagFrom 获取 ctx 中的 trace tag, handler 的 ctx 携带远端请求的 trace tag
+func TraceTagFrom(ctx context.Context) (string, bool) {
+	tag, ok := ctx.Value(tracekey{}).(string)
+	return tag, ok && tag != ""
+}
@@ -0,0 +1,122 @@
+package skynetclusterd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/changlongH/skynet_cluster/codec"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	instrumentationName = "github.com/changlongH/skynet_cluster"
+
+	traceparentHeader = "traceparent"
+)
+
+var (
+	attrNode      = attribute.Key("skynet.node")
+	attrPeer      = attribute.Key("skynet.peer")
+	attrService   = attribute.Key("skynet.service")
+	attrCmd       = attribute.Key("skynet.cmd")
+	attrSession   = attribute.Key("skynet.session")
+	attrSize      = attribute.Key("skynet.payload_size")
+	attrMultipart = attribute.Key("skynet.multipart")
+	attrOk        = attribute.Key("skynet.ok")
+	attrTraceTag  = attribute.Key("skynet.trace_tag")
+
+	traceContext = propagation.TraceContext{}
+)
+
+// WithTracerProvider 使用 tp 创建 Call/Send 和收到的请求的 span, 默认使用 otel.GetTracerProvider()
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(c *Cluster) {
+		c.tracer = tp.Tracer(instrumentationName)
+	}
+}
+
+// WithTraceparentTags 没有 skynet trace tag 的请求把采样的 span 按 W3C traceparent 格式作为 trace tag 发送
+// lua 节点收到 trace tag 后会打开 skynet.tracecall 日志, 所以默认不发送, 只有对端是 Go 节点时再打开
+func WithTraceparentTags() Option {
+	return func(c *Cluster) {
+		c.traceparentTags = true
+	}
+}
+
+func defaultTracer() trace.Tracer {
+	return otel.GetTracerProvider().Tracer(instrumentationName)
+}
+
+// serviceName 字符串地址直接返回, 数字地址同 skynet 格式化为 :0000000a
+func serviceName(addr codec.Addr) string {
+	if addr.Name != "" {
+		return addr.Name
+	}
+	return fmt.Sprintf(":%08x", addr.Id)
+}
+
+func (c *Cluster) startSpan(ctx context.Context, kind trace.SpanKind, pack *codec.ReqPack, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	service := serviceName(pack.Addr)
+	attrs = append(attrs, attrService.String(service), attrCmd.String(pack.Cmd))
+	return c.tracer.Start(ctx, service+"."+pack.Cmd, trace.WithSpanKind(kind), trace.WithAttributes(attrs...))
+}
+
+// setSpanPack 记录打包或者解包之后才知道的 session, 大小和 trace tag
+func setSpanPack(span trace.Span, pack *codec.ReqPack) {
+	if !span.IsRecording() {
+		return
+	}
+	span.SetAttributes(
+		attrSession.Int64(int64(pack.Session)),
+		attrSize.Int(pack.Size),
+		attrMultipart.Bool(pack.Multipart()),
+	)
+	if pack.Trace != "" {
+		span.SetAttributes(attrTraceTag.String(pack.Trace))
+	}
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.SetAttributes(attrOk.Bool(err == nil))
+	span.End()
+}
+
+// outboundTraceTag 请求携带的 trace tag
+// ctx 中有 skynet trace tag 时使用原来的 tag, 保证 lua 节点的 trace 日志可以串起来
+// 否则设置了 WithTraceparentTags 时采样的 span 按 W3C traceparent 格式作为 trace tag
+func (c *Cluster) outboundTraceTag(ctx context.Context) string {
+	if tag, ok := TraceTagFrom(ctx); ok {
+		return tag
+	}
+	if !c.traceparentTags {
+		return ""
+	}
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() || !sc.IsSampled() {
+		return ""
+	}
+	carrier := propagation.MapCarrier{}
+	traceContext.Inject(ctx, carrier)
+	return carrier[traceparentHeader]
+}
+
+// inboundContext 把请求的 trace tag 放入 handler 的 ctx
+// traceparent 格式的 tag 作为远端的父 span, 其他的 tag 作为 skynet trace tag 继续传递
+func inboundContext(ctx context.Context, tag string) context.Context {
+	if tag == "" {
+		return ctx
+	}
+	remote := traceContext.Extract(ctx, propagation.MapCarrier{traceparentHeader: tag})
+	if trace.SpanContextFromContext(remote).IsRemote() {
+		return remote
+	}
+	return WithTraceTag(ctx, tag)
+}
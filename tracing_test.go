@@ -0,0 +1,164 @@
+package skynetclusterd
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func spanAttr(span sdktrace.ReadOnlySpan, key attribute.Key) (attribute.Value, bool) {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func TestTracingSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	server, client := New(WithTracerProvider(tp)), New(WithTracerProvider(tp), WithTraceparentTags())
+	addr := listenTestCluster(t, server)
+	client.RegisterNode("server", addr)
+	defer server.Shutdown(context.Background())
+	defer client.Shutdown(context.Background())
+
+	svc := NewService("otel")
+	svc.Handle("echo", func(ctx context.Context, args []byte) ([]byte, error) {
+		tag, _ := TraceTagFrom(ctx)
+		return []byte(tag), nil
+	})
+	svc.Handle("fail", func(ctx context.Context, args []byte) ([]byte, error) {
+		return nil, errors.New("fail")
+	})
+	server.RegisterService(svc)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	// span context 通过 traceparent 格式的 trace tag 传递到远端
+	if ok, resp := client.Call(ctx, "server", "otel", "echo", "hello"); !ok || resp != "" {
+		t.Fatalf("call echo got (%v, %q)", ok, resp)
+	}
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans want 2", len(spans))
+	}
+	serverSpan, clientSpan := spans[0], spans[1]
+	if clientSpan.SpanKind() != trace.SpanKindClient || serverSpan.SpanKind() != trace.SpanKindServer {
+		t.Fatalf("span kind got %v %v", clientSpan.SpanKind(), serverSpan.SpanKind())
+	}
+	if clientSpan.Name() != "otel.echo" || serverSpan.Parent().SpanID() != clientSpan.SpanContext().SpanID() ||
+		serverSpan.SpanContext().TraceID() != clientSpan.SpanContext().TraceID() {
+		t.Errorf("server span %s is not child of client span %s", serverSpan.Parent().SpanID(), clientSpan.SpanContext().SpanID())
+	}
+	for key, want := range map[attribute.Key]attribute.Value{
+		attrNode:      attribute.StringValue("server"),
+		attrService:   attribute.StringValue("otel"),
+		attrCmd:       attribute.StringValue("echo"),
+		attrMultipart: attribute.BoolValue(false),
+		attrOk:        attribute.BoolValue(true),
+	} {
+		if v, ok := spanAttr(clientSpan, key); !ok || v != want {
+			t.Errorf("client span %s got %v want %v", key, v.Emit(), want.Emit())
+		}
+	}
+	if v, ok := spanAttr(serverSpan, attrSize); !ok || v.AsInt64() == 0 {
+		t.Errorf("server span payload size got %v", v.Emit())
+	}
+
+	// 远端返回错误
+	recorder.Reset()
+	if ok, _ := client.Call(ctx, "server", "otel", "fail", ""); ok {
+		t.Fatal("call fail expect error")
+	}
+	for _, span := range recorder.Ended() {
+		if span.Status().Code != codes.Error {
+			t.Errorf("%v span status got %v", span.SpanKind(), span.Status())
+		}
+	}
+
+	// skynet 的 trace tag 原样传递, 不作为 span context
+	recorder.Reset()
+	tagged := WithTraceTag(ctx, ":0100000a-1")
+	if ok, resp := client.Call(tagged, "server", "otel", "echo", ""); !ok || resp != ":0100000a-1" {
+		t.Errorf("call with trace tag got (%v, %q)", ok, resp)
+	}
+	spans = recorder.Ended()
+	if len(spans) != 2 || spans[0].Parent().IsValid() {
+		t.Fatalf("server span with skynet tag got parent")
+	}
+	if v, _ := spanAttr(spans[0], attrTraceTag); v.AsString() != ":0100000a-1" {
+		t.Errorf("server span trace tag got %v", v.Emit())
+	}
+}
+
+func TestTracingNoTraceparentTags(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	server, client := New(WithTracerProvider(tp)), New(WithTracerProvider(tp))
+	addr := listenTestCluster(t, server)
+	client.RegisterNode("server", addr)
+	defer server.Shutdown(context.Background())
+	defer client.Shutdown(context.Background())
+
+	traced := make(chan bool, 1)
+	svc := NewService("otel")
+	svc.Handle("check", func(ctx context.Context, args []byte) ([]byte, error) {
+		_, ok := TraceTagFrom(ctx)
+		traced <- ok || trace.SpanContextFromContext(ctx).IsRemote()
+		return nil, nil
+	})
+	server.RegisterService(svc)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	// 采样的 span 默认不作为 trace tag 发送, 避免打开 lua 节点的 trace 日志
+	if ok, resp := client.Call(ctx, "server", "otel", "check", ""); !ok {
+		t.Fatal(resp)
+	}
+	if <-traced {
+		t.Error("call without WithTraceparentTags sent trace tag")
+	}
+	spans := recorder.Ended()
+	if len(spans) != 2 || spans[0].Parent().IsValid() {
+		t.Errorf("server span got parent without trace tag")
+	}
+}
+
+func TestTracingNotSampled(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSampler(sdktrace.NeverSample()), sdktrace.WithSpanProcessor(recorder))
+	server, client := New(), New(WithTracerProvider(tp), WithTraceparentTags())
+	addr := listenTestCluster(t, server)
+	client.RegisterNode("server", addr)
+	defer server.Shutdown(context.Background())
+	defer client.Shutdown(context.Background())
+
+	traced := make(chan bool, 1)
+	svc := NewService("otel")
+	svc.Handle("check", func(ctx context.Context, args []byte) ([]byte, error) {
+		_, ok := TraceTagFrom(ctx)
+		traced <- ok || trace.SpanContextFromContext(ctx).IsValid()
+		return nil, nil
+	})
+	server.RegisterService(svc)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	// 没有采样的请求不发送 trace 包
+	if ok, resp := client.Call(ctx, "server", "otel", "check", ""); !ok {
+		t.Fatal(resp)
+	}
+	if <-traced || len(recorder.Ended()) != 0 {
+		t.Error("unsampled call got trace")
+	}
+}
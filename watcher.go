@@ -0,0 +1,155 @@
+package skynetclusterd
+
+import (
+	"bytes"
+	"os"
+	"sync"
+	"time"
+)
+
+// ConfigWatcher 定时检查配置文件, 文件变化时对比新旧配置并更新节点表, 对应 cluster.reload
+//   - 删除的节点: UnRegisterNode, 已经建立的链接等待中的请求完成后关闭
+//   - 地址变化的节点: 关闭旧的链接, 下次请求时重新建立链接
+//   - 新增的节点: 注册后可以访问
+type ConfigWatcher struct {
+	c        *Cluster
+	path     string
+	interval time.Duration
+	stopCh   chan struct{}
+	stopOnce sync.Once
+
+	sync.Mutex
+	modTime time.Time
+	size    int64
+	data    []byte
+	current *ClusterConfig
+	err     error
+}
+
+// WatchConfig 加载配置文件并且每隔 interval 检查一次文件是否变化
+func (c *Cluster) WatchConfig(path string, interval time.Duration) (*ConfigWatcher, error) {
+	w := &ConfigWatcher{
+		c:        c,
+		path:     path,
+		interval: interval,
+		stopCh:   make(chan struct{}),
+	}
+	if _, err := w.check(); err != nil {
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+func WatchConfig(path string, interval time.Duration) (*ConfigWatcher, error) {
+	return defaultCluster.WatchConfig(path, interval)
+}
+
+func (w *ConfigWatcher) run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	var lastErr string
+	for {
+		select {
+		case <-ticker.C:
+			changed, err := w.check()
+			switch {
+			case err != nil:
+				// 同样的错误只记录一次
+				if err.Error() != lastErr {
+					w.c.log().Warn("reload config failed, keep previous config", "path", w.path, "error", err)
+				}
+				lastErr = err.Error()
+			case changed:
+				w.c.log().Info("config reloaded", "path", w.path, "nodes", len(w.Config().Nodes))
+			}
+			if err == nil {
+				lastErr = ""
+			}
+		case <-w.stopCh:
+			return
+		}
+	}
+}
+
+func (w *ConfigWatcher) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stopCh)
+	})
+}
+
+// Config 当前生效的配置
+func (w *ConfigWatcher) Config() *ClusterConfig {
+	w.Lock()
+	defer w.Unlock()
+	return w.current
+}
+
+// Err 最近一次加载配置的错误, 加载失败时保持之前的配置
+func (w *ConfigWatcher) Err() error {
+	w.Lock()
+	defer w.Unlock()
+	return w.err
+}
+
+// check 文件变化时重新加载, 返回配置是否更新
+func (w *ConfigWatcher) check() (bool, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	info, err := os.Stat(w.path)
+	if err != nil {
+		w.err = err
+		return false, err
+	}
+	if w.current != nil && info.ModTime().Equal(w.modTime) && info.Size() == w.size {
+		return false, nil
+	}
+	w.modTime, w.size = info.ModTime(), info.Size()
+
+	data, err := os.ReadFile(w.path)
+	if err != nil {
+		w.err = err
+		return false, err
+	}
+	if w.current != nil && bytes.Equal(data, w.data) {
+		return false, nil
+	}
+	// 解析已经读出的内容, 保证记录的内容和生效的配置一致
+	conf, err := parseConfigFile(w.path, data)
+	if err != nil {
+		w.err = err
+		return false, err
+	}
+	w.c.reloadConfig(w.current, conf)
+	w.data = data
+	w.current = conf
+	w.err = nil
+	return true, nil
+}
+
+// reloadConfig 对比新旧配置更新节点表, old 为 nil 时等同于 ApplyConfig
+func (c *Cluster) reloadConfig(old, conf *ClusterConfig) {
+	if old != nil {
+		for name := range old.Nodes {
+			if _, ok := conf.Nodes[name]; !ok {
+				c.UnRegisterNode(name)
+			}
+		}
+	}
+	if conf.NoWaiting != nil {
+		c.SetNoWaiting(*conf.NoWaiting)
+	}
+	for name, addr := range conf.Nodes {
+		if old != nil {
+			if oldAddr, ok := old.Nodes[name]; ok && oldAddr == addr {
+				continue
+			}
+		}
+		if addr == "" {
+			c.SetNodeDown(name)
+		} else {
+			c.RegisterNode(name, addr)
+		}
+	}
+}
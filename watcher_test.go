@@ -0,0 +1,88 @@
+package skynetclusterd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchConfig(t *testing.T) {
+	addrA := startTestNode(t, "watch_a")
+	addrB := startTestNode(t, "watch_b")
+
+	release := make(chan struct{})
+	svc := NewService("watch")
+	svc.Handle("block", func(ctx context.Context, args []byte) ([]byte, error) {
+		<-release
+		return args, nil
+	})
+	RegisterService(svc)
+	defer UnRegisterService("watch")
+
+	path := filepath.Join(t.TempDir(), "clustername.lua")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// 保证 mtime 发生变化
+		now := time.Now().Add(time.Second)
+		os.Chtimes(path, now, now)
+	}
+	write(fmt.Sprintf("watch1 = %q\nwatch2 = %q\n", addrA, addrA))
+
+	w, err := WatchConfig(path, 5*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	defer UnRegisterNode("watch1")
+	defer UnRegisterNode("watch3")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	agent, err := GetNodeSenderAgent("watch2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(chan bool)
+	go func() {
+		ok, _ := Call(ctx, "watch2", "watch", "block", "")
+		result <- ok
+	}()
+	for agent.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	write(fmt.Sprintf("watch1 = %q\nwatch3 = %q\n", addrB, addrA))
+	for w.Config().Nodes["watch3"] == "" {
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, ok := GetRegisterNodeAddr("watch2"); ok {
+		t.Errorf("watch2 not removed")
+	}
+	if addr, _ := GetRegisterNodeAddr("watch1"); addr != addrB {
+		t.Errorf("watch1 addr got %s want %s", addr, addrB)
+	}
+	if addr, _ := GetRegisterNodeAddr("watch3"); addr != addrA {
+		t.Errorf("watch3 addr got %s want %s", addr, addrA)
+	}
+
+	// 删除的节点等待中的请求仍然可以完成
+	close(release)
+	if ok := <-result; !ok {
+		t.Errorf("pending call on removed node failed")
+	}
+
+	write("watch1 = ")
+	for w.Err() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	if addr, _ := GetRegisterNodeAddr("watch1"); addr != addrB {
+		t.Errorf("invalid config should keep watch1 addr %s", addrB)
+	}
+}